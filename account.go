@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Accounts are not stored anywhere explicitly - account exists if there is
+// at least one record with TableID|Account|0 key for any of these tables.
+var accTables = map[string]int{
+	"counters":      cd.AtomicPrefix,
+	"locks":         cd.LocksPrefix,
+	"idempotency":   cd.IdempotencyPrefix,
+	"keys":          cd.KVPrefix,
+	"history":       cd.HistoryPrefix,
+	"index_defs":    cd.IndexDefPrefix,
+	"index":         cd.IndexPrefix,
+	"usage":         cd.UsagePrefix,
+	"queues":        cd.QueuePrefix,
+	"queue_meta":    cd.QueueMetaPrefix,
+	"queue_lease":   cd.QueueLeasePrefix,
+	"queue_delay":   cd.QueueDelayPrefix,
+	"queue_group":   cd.QueueGroupPrefix,
+	"queue_backlog": cd.QueueBacklogPrefix,
+	"topics":        cd.TopicPrefix,
+	"topic_meta":    cd.TopicMetaPrefix,
+	"topic_group":   cd.TopicGroupPrefix,
+}
+
+// tables that are copied when account is cloned. Locks and idempotency
+// records belong to running clients and are not copied.
+var accCopyTables = []int{
+	cd.AtomicPrefix,
+	cd.KVPrefix,
+	cd.HistoryPrefix,
+	cd.IndexDefPrefix,
+	cd.IndexPrefix,
+	cd.UsagePrefix,
+	cd.QueuePrefix,
+	cd.QueueMetaPrefix,
+	cd.QueueLeasePrefix,
+	cd.QueueDelayPrefix,
+	cd.QueueGroupPrefix,
+	cd.QueueBacklogPrefix,
+	cd.TopicPrefix,
+	cd.TopicMetaPrefix,
+	cd.TopicGroupPrefix,
+}
+
+func listAccounts(after string, limit int) ([]string, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	found := map[string]struct{}{}
+	for _, t := range accTables {
+		lower := []byte{byte(t)}
+		if after != "" {
+			lower = accUpperBound(t, after)
+		}
+		iter, err := store.db.NewIter(&pebble.IterOptions{
+			LowerBound: lower,
+			UpperBound: []byte{byte(t) + 1},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// skip-scan: jump over all records of the account to the next one
+		n := 0
+		for iter.First(); iter.Valid() && n < limit; n++ {
+			k := iter.Key()[1:]
+			i := bytes.IndexByte(k, 0)
+			if i == -1 {
+				iter.Next()
+				continue
+			}
+			acc := string(k[:i])
+			found[acc] = struct{}{}
+			iter.SeekGE(accUpperBound(t, acc))
+		}
+		err = iter.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := make([]string, 0, len(found))
+	for acc := range found {
+		res = append(res, acc)
+	}
+	sort.Strings(res)
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+type TableStats struct {
+	Count int64
+	Bytes int64
+}
+
+type AccountStats struct {
+	Tables map[string]TableStats
+	Usage  map[string]int64 // counters used for quotas
+}
+
+func accountStats(acc string) (AccountStats, error) {
+	res := AccountStats{
+		Tables: map[string]TableStats{},
+		Usage:  map[string]int64{},
+	}
+	snap := store.db.NewSnapshot()
+	defer snap.Close()
+	for name, t := range accTables {
+		iter, err := snap.NewIter(&pebble.IterOptions{
+			LowerBound: compID(t, acc, ""),
+			UpperBound: accUpperBound(t, acc),
+		})
+		if err != nil {
+			return res, err
+		}
+		var st TableStats
+		for iter.First(); iter.Valid(); iter.Next() {
+			st.Count++
+			st.Bytes += int64(len(iter.Key()) + len(iter.Value()))
+		}
+		err = iter.Close()
+		if err != nil {
+			return res, err
+		}
+		res.Tables[name] = st
+	}
+	for _, name := range []string{usageKeys, usageBytes} {
+		v, err := getUsage(acc, snap, name)
+		if err != nil {
+			return res, err
+		}
+		res.Usage[name] = v
+	}
+	return res, nil
+}
+
+// deleteAccount removes all data of the account, releases its locks
+// and wakes up watchers of its keys.
+func deleteAccount(acc string) error {
+	var keys []string
+	var ver int64
+	err := store.Singleton([]byte(acc), func() error {
+		iter, err := store.db.NewIter(&pebble.IterOptions{
+			LowerBound: compID(cd.KVPrefix, acc, ""),
+			UpperBound: accUpperBound(cd.KVPrefix, acc),
+		})
+		if err != nil {
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()[len(acc)+2:]))
+		}
+		err = iter.Close()
+		if err != nil {
+			return err
+		}
+		seq, err := GetInt64(compID1(cd.VerSequencePrefix, acc), store.db)
+		if err != nil {
+			return err
+		}
+		ver = 1
+		if seq != nil {
+			ver = *seq
+		}
+
+		b := store.db.NewBatch()
+		for _, t := range accTables {
+			err := b.DeleteRange(compID(t, acc, ""), accUpperBound(t, acc), pebble.NoSync)
+			if err != nil {
+				return err
+			}
+		}
+		// keep version sequence, so that watchers of re-created account
+		// never see versions they've seen already
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return err
+		}
+		idxMu.Lock()
+		delete(indexes, acc)
+		idxMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	memUnlockAccount(acc)
+	n := store.notifier(acc)
+	for _, k := range keys {
+		n.NotifyVersion(k, ver)
+	}
+	return nil
+}
+
+// copyAccount clones data of one account into another, empty one.
+func copyAccount(from, to string) error {
+	if from == to {
+		return fmt.Errorf("can't copy account into itself")
+	}
+	snap := store.db.NewSnapshot()
+	defer snap.Close()
+	return store.Singleton([]byte(to), func() error {
+		for _, t := range accTables {
+			iter, err := store.db.NewIter(&pebble.IterOptions{
+				LowerBound: compID(t, to, ""),
+				UpperBound: accUpperBound(t, to),
+			})
+			if err != nil {
+				return err
+			}
+			exists := iter.First()
+			err = iter.Close()
+			if err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("account %v is not empty", to)
+			}
+		}
+		b := store.db.NewBatch()
+		for _, t := range accCopyTables {
+			iter, err := snap.NewIter(&pebble.IterOptions{
+				LowerBound: compID(t, from, ""),
+				UpperBound: accUpperBound(t, from),
+			})
+			if err != nil {
+				return err
+			}
+			for iter.First(); iter.Valid(); iter.Next() {
+				rest := iter.Key()[len(from)+2:]
+				err := b.Set(compID(t, to, string(rest)), iter.Value(), pebble.NoSync)
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			err = iter.Close()
+			if err != nil {
+				return err
+			}
+		}
+		seq, err := GetInt64(compID1(cd.VerSequencePrefix, from), snap)
+		if err != nil {
+			return err
+		}
+		// sequence of deleted account is kept, so that its watchers never
+		// see versions they've seen already - don't move it back
+		cur, err := GetInt64(compID1(cd.VerSequencePrefix, to), store.db)
+		if err != nil {
+			return err
+		}
+		if seq != nil && (cur == nil || *cur < *seq) {
+			err = SetInt64(compID1(cd.VerSequencePrefix, to), *seq, b)
+			if err != nil {
+				return err
+			}
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return err
+		}
+		idxMu.Lock()
+		indexes[to] = append([]IndexDef{}, indexes[from]...)
+		idxMu.Unlock()
+		// copied messages are returned to the queue, when their lease expires
+		err = restoreLeases(&pebble.IterOptions{
+			LowerBound: compID(cd.QueueLeasePrefix, to, ""),
+			UpperBound: accUpperBound(cd.QueueLeasePrefix, to),
+		})
+		if err != nil {
+			return err
+		}
+		return indexDelayed(to)
+	})
+}
+
+type AccountsRequest struct {
+	After string // for pagination
+	Limit int
+}
+
+type CopyAccountRequest struct {
+	To string
+}
+
+func AccountsHandler(ctx *fasthttp.RequestCtx) {
+	if !checkAuth(ctx, access{"*", "", PermAdmin}) {
+		return
+	}
+	var req AccountsRequest
+	if len(ctx.Request.Body()) > 0 {
+		err := json.Unmarshal(ctx.Request.Body(), &req)
+		if err != nil {
+			writeError(ctx, err)
+			return
+		}
+	}
+	res, err := listAccounts(req.After, req.Limit)
+	writeJSON(ctx, res, err)
+}
+
+func AccountStatsHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if !checkAuth(ctx, access{acc, "", PermAdmin}) {
+		return
+	}
+	res, err := accountStats(acc)
+	writeJSON(ctx, res, err)
+}
+
+func AccountDeleteHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if !checkAuth(ctx, access{acc, "", PermAdmin}) {
+		return
+	}
+	err = deleteAccount(acc)
+	writeJSON(ctx, struct{}{}, err)
+}
+
+func AccountCopyHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var req CopyAccountRequest
+	err = json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	err = validAcc(req.To)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if !checkAuth(ctx, access{acc, "", PermAdmin}, access{req.To, "", PermAdmin}) {
+		return
+	}
+	err = copyAccount(acc, req.To)
+	writeJSON(ctx, struct{}{}, err)
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, res interface{}, err error) {
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	d, err := json.Marshal(res)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	ctx.Response.SetBody(d)
+}
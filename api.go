@@ -19,16 +19,60 @@ type AtomicOp struct {
 }
 
 type KV struct {
-	Key     string
-	Value   json.RawMessage
-	Delete  bool
-	Version int64
+	Key           string
+	Value         json.RawMessage
+	Delete        bool
+	Version       int64
+	CreateVersion int64  `json:",omitempty"`
+	Created       int64  `json:",omitempty"` // unix time
+	Updated       int64  `json:",omitempty"` // unix time
+	Writer        string `json:",omitempty"` // who made last change
+	ContentType   string `json:",omitempty"` // set for raw values. Value is base64 string
+}
+
+// jsonValue returns raw (non-JSON) values as base64 JSON string
+func jsonValue(data []byte, contentType string) json.RawMessage {
+	if contentType == "" {
+		return data
+	}
+	d, _ := json.Marshal(data)
+	return d
+}
+
+func newKV(key string, v *cd.KV) KV {
+	return KV{
+		Key:           key,
+		Value:         jsonValue(v.Data, v.ContentType),
+		ContentType:   v.ContentType,
+		Version:       v.Version,
+		CreateVersion: v.CreateVersion,
+		Created:       v.Created,
+		Updated:       v.Updated,
+		Writer:        v.Writer,
+	}
+}
+
+// KVOp atomically modifies a field inside of JSON document
+type KVOp struct {
+	Key   string
+	Path  string          // JSONPath of the field, $ for whole document
+	Op    string          // incr | append | add_to_set | remove
+	Value json.RawMessage // number to add or array element
 }
 
 type EnqueueOp struct {
-	Queue    string
+	Queue     string
+	Messages  []json.RawMessage
+	Counter   int64  // enqueue only if counter of the queue is equal. 0 - any
+	Delay     int    // seconds to wait before delivery
+	DeliverAt int64  // unix time of delivery. Used if Delay is not set
+	Priority  int    // requires queue with Priorities. Higher - dequeued first
+	Group     string // messages of a group are delivered in order, one at a time
+}
+
+type PublishOp struct {
+	Topic    string
 	Messages []json.RawMessage
-	Counter  int64
 }
 
 type Request struct {
@@ -39,10 +83,32 @@ type Request struct {
 	UnlockID string
 	Unlock   int64 // if both lockid & unlockid = extend the lock
 
-	IdempotencyIDs []string // TODO: configure Idempotency Records  TTL (merge function)
+	IdempotencyIDs []string
+	IdempotencyTTL int    // seconds to keep idempotency records. 0 - configured TTL
+	reqHash        []byte // set if request has Idempotency-Key header
 	Atomic         []AtomicOp
 	KVSet          []*KV
-	KVGet          []string
+	KVGet          []KVGetOp
+	KVOps          []KVOp
+	Enqueue        []EnqueueOp
+	Publish        []PublishOp
+	Writer         string // optional writer identity stored with KVSet & KVOps
+}
+
+// KVGetOp can be passed either as a plain key string or as an object
+// with Path to return only a part of the stored JSON document.
+type KVGetOp struct {
+	Key     string
+	Path    string // JSONPath, i.e. $.limits.daily
+	Version int64  // read past version. Requires history retention for key
+}
+
+func (o *KVGetOp) UnmarshalJSON(d []byte) error {
+	if len(d) > 0 && d[0] == '"' {
+		return json.Unmarshal(d, &o.Key)
+	}
+	type plain KVGetOp
+	return json.Unmarshal(d, (*plain)(o))
 }
 
 type AtomicRes struct {
@@ -59,20 +125,12 @@ type Response struct {
 	// during repair - any actions are not performed - to allow app to handle repair.
 	// if repair is not needed - app can simply resend requires with
 	// handleID to extend the lock and apply operations
-	KVGet  []KV        `json:"kv,omitempty"`
-	Atomic []AtomicRes `json:"atm,omitempty"`
-}
-
-func handleIdempotency(acc string, b *pebble.Batch, id string) error {
-	_, closer, err := b.Get(compID(cd.IdempotencyPrefix, acc, id))
-	if err != nil && err == pebble.ErrNotFound {
-		return nil
-	}
-	if err != nil {
-		return err
-	}
-	closer.Close()
-	return fmt.Errorf("duplicate request: " + id)
+	KVGet   []KV         `json:"kv,omitempty"`
+	Atomic  []AtomicRes  `json:"atm,omitempty"`
+	KVOps   []KV         `json:"kvop,omitempty"`   // new value of the field
+	Enqueue []EnqueueRes `json:"enq,omitempty"`    // IDs of enqueued messages
+	Publish []PublishRes `json:"pub,omitempty"`    // offsets of published messages
+	Replay  bool         `json:"replay,omitempty"` // stored response of already handled request
 }
 
 func handleAtomic(acc string, b *pebble.Batch, op AtomicOp, res *Response) error {
@@ -115,14 +173,80 @@ func handleAtomic(acc string, b *pebble.Batch, op AtomicOp, res *Response) error
 	return fmt.Errorf("empty atomic request")
 }
 
+func getKV(acc string, b pebble.Reader, key string) (*cd.KV, error) {
+	d, closer, err := b.Get(compID(cd.KVPrefix, acc, key))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer closer.Close()
+	return decodeKV(d)
+}
+
+func decodeKV(d []byte) (*cd.KV, error) {
+	var v cd.KV
+	_, err := v.UnmarshalMsg(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	v.Data, err = decrypt(v.KeyID, v.DEK, v.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	v.KeyID, v.DEK = "", nil
+	v.Data, err = decompress(v.Data, v.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	v.Compression = cd.CompressionNone
+	return &v, nil
+}
+
 func handleKVSet(acc string, b *pebble.Batch, v *KV) error {
+	err := saveHistory(acc, b, v)
+	if err != nil {
+		return err
+	}
+	old, err := getKV(acc, b, v.Key)
+	if err != nil {
+		return err
+	}
+	err = updateUsage(acc, b, old, v)
+	if err != nil {
+		return err
+	}
+	var oldData, newData []byte
+	if old != nil {
+		oldData = old.Data
+	}
+	if !v.Delete {
+		newData = v.Value
+	}
+	err = updateIndexes(acc, b, v.Key, oldData, newData)
+	if err != nil {
+		return err
+	}
 	if v.Delete {
 		return b.Delete(compID(cd.KVPrefix, acc, v.Key), pebble.NoSync)
 	}
+	now := time.Now().Unix()
 	dv := cd.KV{
-		Data:    v.Value,
-		Version: v.Version, // TODO: rename to sequence
+		Data:          v.Value,
+		Version:       v.Version, // TODO: rename to sequence
+		CreateVersion: v.Version,
+		Created:       now,
+		Updated:       now,
+		Writer:        v.Writer,
+		ContentType:   v.ContentType,
 	}
+	if old != nil {
+		dv.CreateVersion = old.CreateVersion
+		dv.Created = old.Created
+	}
+	dv.Data, dv.Compression = compress(dv.Data)
+	dv.KeyID, dv.DEK, dv.Data = encrypt(dv.Data)
 	d, err := dv.MarshalMsg(nil)
 	if err != nil {
 		return err
@@ -131,38 +255,136 @@ func handleKVSet(acc string, b *pebble.Batch, v *KV) error {
 	return b.Set(compID(cd.KVPrefix, acc, v.Key), d, pebble.NoSync)
 }
 
-func handleKVGet(acc string, b *pebble.Batch, key string, res *Response) error {
-	d, closer, err := b.Get(compID(cd.KVPrefix, acc, key))
+func handleKVOp(acc string, b *pebble.Batch, op KVOp, ver int64, writer string, res *Response) error {
+	path, err := parseJSONPath(op.Path)
 	if err != nil {
-		if err != pebble.ErrNotFound {
+		return err
+	}
+	arg, err := decodeJSON(op.Value)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	v, err := getKV(acc, b, op.Key)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		if v.ContentType != "" {
+			return fmt.Errorf("%w: %v is a raw %v value", cd.ErrPreconditionFailed, op.Key, v.ContentType)
+		}
+		doc, err = decodeJSON(v.Data)
+		if err != nil {
+			return fmt.Errorf("value is not a JSON document: %v", err)
+		}
+	}
+	var field interface{}
+	doc, err = path.Update(doc, func(old interface{}, found bool) (interface{}, error) {
+		field, err = applyJSONOp(op.Op, old, found, arg)
+		return field, err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v %v: %v", cd.ErrPreconditionFailed, op.Key, op.Path, err)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	fd, err := json.Marshal(field)
+	if err != nil {
+		return err
+	}
+	res.KVOps = append(res.KVOps, KV{
+		Key:     op.Key,
+		Value:   fd,
+		Version: ver,
+	})
+	return handleKVSet(acc, b, &KV{
+		Key:     op.Key,
+		Value:   data,
+		Version: ver,
+		Writer:  writer,
+	})
+}
+
+func handleKVGet(acc string, b pebble.Reader, op KVGetOp, res *Response) error {
+	var path jsonPath
+	if op.Path != "" {
+		var err error
+		path, err = parseJSONPath(op.Path)
+		if err != nil {
+			return err
+		}
+	}
+	if op.Version != 0 {
+		h, err := getHistory(acc, b, op.Key, op.Version)
+		if err != nil {
 			return err
 		}
+		if h == nil || h.Deleted {
+			return fmt.Errorf("%w: version %v of %v", cd.ErrNotFound, op.Version, op.Key)
+		}
+		val := jsonValue(h.Data, h.Type)
+		if path != nil {
+			val = path.Extract(h.Data)
+		}
 		res.KVGet = append(res.KVGet, KV{
-			Key:     key,
-			Version: 0, // 0 version
+			Key:         op.Key,
+			Value:       val,
+			Version:     h.Version,
+			Updated:     h.Time,
+			Writer:      h.Writer,
+			ContentType: h.Type,
 		})
+		return nil
 	}
-	defer closer.Close()
-	var v cd.KV
-	_, err = v.UnmarshalMsg(d)
+	v, err := getKV(acc, b, op.Key)
 	if err != nil {
 		return err
 	}
-	res.KVGet = append(res.KVGet, KV{
-		Key:     key,
-		Value:   v.Data,
-		Version: v.Version,
-	})
+	if v == nil {
+		res.KVGet = append(res.KVGet, KV{
+			Key:     op.Key,
+			Version: 0, // 0 version
+		})
+		return nil
+	}
+	kv := newKV(op.Key, v)
+	if path != nil {
+		kv.Value = path.Extract(v.Data)
+	}
+	res.KVGet = append(res.KVGet, kv)
 	return nil
 }
 
 func handle(acc string, req Request) (Response, error) {
 	var res Response
+	err := allowRequest(acc)
+	if err != nil {
+		return res, err
+	}
+	// duplicate request - don't touch locks, just return the original response
+	replay, err := getIdempotency(acc, store.db, &req)
+	if err != nil {
+		return res, err
+	}
+	if replay != nil {
+		return *replay, nil
+	}
+	if req.LockID != "" && req.LockID != req.UnlockID && req.LockWait > 0 {
+		if !waitSlots.acquire(acc, accQuota(acc).MaxWaiters) {
+			return res, quotaErr("max %v lock waiters", accQuota(acc).MaxWaiters)
+		}
+		defer waitSlots.release(acc)
+	}
 
 	lockOnly := len(req.IdempotencyIDs) == 0 &&
 		len(req.Atomic) == 00 &&
 		len(req.KVGet) == 0 &&
-		len(req.KVSet) == 0
+		len(req.KVSet) == 0 &&
+		len(req.KVOps) == 0 &&
+		len(req.Enqueue) == 0 &&
+		len(req.Publish) == 0
 
 	b := store.db.NewIndexedBatch() // TODO: maybe normal batch will work too
 	if req.UnlockID != "" || req.LockID != "" {
@@ -179,13 +401,13 @@ func handle(acc string, req Request) (Response, error) {
 				}
 				err = b.Delete(compID(cd.LocksPrefix, acc, req.UnlockID), pebble.NoSync)
 				if err != nil {
-					return res, fmt.Errorf(err.Error())
+					return res, err
 				}
 			}
 			if req.LockID != "" { // lock
 				newHandle, err := memLock(acc, req.LockID, req.LockDur, req.LockWait)
 				if err != nil {
-					return res, fmt.Errorf(err.Error())
+					return res, err
 				}
 				res.Lock = newHandle
 				c := cd.Lock{
@@ -194,17 +416,17 @@ func handle(acc string, req Request) (Response, error) {
 				}
 				d, err := c.MarshalMsg(nil)
 				if err != nil {
-					return res, fmt.Errorf(err.Error())
+					return res, err
 				}
 				if lockOnly {
 					err = store.db.Set(compID(cd.LocksPrefix, acc, req.LockID), d, pebble.Sync)
 					if err != nil {
-						return res, fmt.Errorf(err.Error())
+						return res, err
 					}
 				} else {
 					err = b.Set(compID(cd.LocksPrefix, acc, req.LockID), d, pebble.NoSync)
 					if err != nil {
-						return res, fmt.Errorf(err.Error())
+						return res, err
 					}
 				}
 			}
@@ -216,11 +438,11 @@ func handle(acc string, req Request) (Response, error) {
 		// all updates for single key are performed sequentially, but flushed to
 		// disk together. See store.Update for more info
 		err := store.Singleton(ukey, func() error {
-			for _, v := range req.IdempotencyIDs {
-				err := handleIdempotency(acc, b, v)
-				if err != nil {
-					return err
-				}
+			// duplicate was sent concurrently with the original request
+			rep, err := getIdempotency(acc, b, &req)
+			if err != nil || rep != nil {
+				replay = rep
+				return err
 			}
 			for _, v := range req.Atomic {
 				err := handleAtomic(acc, b, v, &res)
@@ -234,7 +456,7 @@ func handle(acc string, req Request) (Response, error) {
 					return err
 				}
 			}
-			if len(req.KVSet) > 0 {
+			if len(req.KVSet) > 0 || len(req.KVOps) > 0 {
 				seqID := compID1(cd.VerSequencePrefix, acc)
 				ver, err := GetInt64(seqID, b)
 				if err != nil {
@@ -245,6 +467,9 @@ func handle(acc string, req Request) (Response, error) {
 					v = *ver
 				}
 				for _, val := range req.KVSet {
+					if val.Writer == "" {
+						val.Writer = req.Writer
+					}
 					val.Version = v
 					v++
 					err = handleKVSet(acc, b, val)
@@ -252,13 +477,50 @@ func handle(acc string, req Request) (Response, error) {
 						return err
 					}
 				}
+				for _, op := range req.KVOps {
+					err = handleKVOp(acc, b, op, v, req.Writer, &res)
+					if err != nil {
+						return err
+					}
+					v++
+				}
 				err = SetInt64(seqID, v, b)
 				if err != nil {
 					panic(err)
 				}
 			}
-			return b.Commit(pebble.NoSync)
+			for _, op := range req.Enqueue {
+				err := handleEnqueue(acc, b, op, &res)
+				if err != nil {
+					return err
+				}
+			}
+			for _, op := range req.Publish {
+				r, err := handlePublish(acc, b, op.Topic, op.Messages)
+				if err != nil {
+					return err
+				}
+				res.Publish = append(res.Publish, r)
+			}
+			err = saveIdempotency(acc, b, &req, &res)
+			if err != nil {
+				return err
+			}
+			err = b.Commit(pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			return nil
 		})
+		if err == nil && replay != nil {
+			if req.LockID != req.UnlockID && req.LockID != "" {
+				err := memUnlock(acc, req.LockID, res.Lock)
+				if err != nil {
+					log.Print("failed to unlock after duplicate request")
+				}
+			}
+			return *replay, nil
+		}
 		if err != nil {
 			if req.LockID != req.UnlockID && req.LockID != "" { // locked, but request failed - unlock
 				err := memUnlock(acc, req.LockID, res.Lock)
@@ -266,7 +528,7 @@ func handle(acc string, req Request) (Response, error) {
 					log.Print("failed to unlock after lock + failed write")
 				}
 			}
-			return res, fmt.Errorf("err updating: " + err.Error())
+			return res, fmt.Errorf("err updating: %w", err)
 		}
 	}
 	if req.LockID != req.UnlockID && req.UnlockID != "" { // unlock
@@ -277,13 +539,18 @@ func handle(acc string, req Request) (Response, error) {
 		if lockOnly {
 			err = store.db.Delete(compID(cd.LocksPrefix, acc, req.UnlockID), pebble.Sync)
 			if err != nil {
-				return res, fmt.Errorf(err.Error())
+				return res, err
 			}
 		}
 	}
 	for _, val := range req.KVSet {
 		store.notifier(acc).NotifyVersion(val.Key, val.Version)
 	}
+	for _, val := range res.KVOps {
+		store.notifier(acc).NotifyVersion(val.Key, val.Version)
+	}
+	notifyQueues(acc, res.Enqueue)
+	notifyTopics(acc, res.Publish)
 
 	return res, nil
 }
@@ -293,24 +560,31 @@ var ccc int64
 func RequestHandler(ctx *fasthttp.RequestCtx) {
 	acc, err := getAcc(ctx)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
 	var req Request
 	err = json.Unmarshal(ctx.Request.Body(), &req)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
+		return
+	}
+	if !checkAuth(ctx, requestACL(acc, &req)...) {
 		return
 	}
+	idempotencyKeys(ctx, &req)
 	res, err := handle(acc, req)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
+	if res.Replay {
+		ctx.Response.Header.Set("Idempotent-Replayed", "true")
+	}
 
 	d, err := json.Marshal(res)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
 	ctx.Response.SetBody(d)
@@ -324,55 +598,55 @@ type WatchRequest struct {
 func WatchHandler(ctx *fasthttp.RequestCtx) {
 	acc, err := getAcc(ctx)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
 	var req WatchRequest
 	err = json.Unmarshal(ctx.Request.Body(), &req)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
 	if req.ID == "" {
-		ctx.Error("id to watch is empty", 400)
+		writeError(ctx, fmt.Errorf("id to watch is empty"))
+		return
+	}
+	if !checkAuth(ctx, access{acc, req.ID, PermWatch}) {
 		return
 	}
 	kv, err := watcher(acc, req.ID, req.Version)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
 	d, err := json.Marshal(kv)
 	if err != nil {
-		ctx.Error(err.Error(), 400)
+		writeError(ctx, err)
 		return
 	}
 	ctx.Response.SetBody(d)
 }
 
 func watcher(acc string, key string, ver int64) (KV, error) {
+	err := allowRequest(acc)
+	if err != nil {
+		return KV{}, err
+	}
+	if !watchSlots.acquire(acc, accQuota(acc).MaxWatchers) {
+		return KV{}, quotaErr("max %v watchers", accQuota(acc).MaxWatchers)
+	}
+	defer watchSlots.release(acc)
 	n := store.notifier(acc)
 	var kv *KV
-	err := store.Singleton([]byte(acc), func() error {
-		d, closer, err := store.db.Get(compID(cd.KVPrefix, acc, key))
-		if err != nil && err != pebble.ErrNotFound {
+	err = store.Singleton([]byte(acc), func() error {
+		v, err := getKV(acc, store.db, key)
+		if err != nil {
 			return err
 		}
-		if err == nil {
-			defer closer.Close()
-			var v cd.KV
-			_, err = v.UnmarshalMsg(d)
-			if err != nil {
-				return err
-			}
-			if v.Version != ver {
-				kv = &KV{
-					Key:     key,
-					Value:   v.Data,
-					Version: v.Version,
-				}
-				return nil
-			}
+		if v != nil && v.Version != ver {
+			res := newKV(key, v)
+			kv = &res
+			return nil
 		}
 		n.Attach(key, ver)
 		return nil
@@ -385,22 +659,14 @@ func watcher(acc string, key string, ver int64) (KV, error) {
 	}
 	retV := n.Listen(key, ver, 30)
 	if retV == -1 { // timeout
-		return KV{}, fmt.Errorf("no change")
+		return KV{}, cd.ErrNoChange
 	}
-	d, closer, err := store.db.Get(compID(cd.KVPrefix, acc, key))
+	v, err := getKV(acc, store.db, key)
 	if err != nil {
 		return KV{}, err
 	}
-	defer closer.Close()
-
-	var v cd.KV
-	_, err = v.UnmarshalMsg(d)
-	if err != nil {
-		return KV{}, err
+	if v == nil { // deleted
+		return KV{Key: key, Delete: true, Version: retV}, nil
 	}
-	return KV{
-		Key:     key,
-		Value:   v.Data,
-		Version: v.Version,
-	}, nil
+	return newKV(key, v), nil
 }
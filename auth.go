@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	PermRead  = "read"
+	PermWrite = "write"
+	PermLock  = "lock"
+	PermWatch = "watch"
+	PermAdmin = "admin"
+)
+
+// Clients authenticate with "Authorization: Bearer <secret>" header, where
+// secret is one of:
+//   - static API key from config.yml
+//   - API key stored in SystemAccount under "apikeys/<key>" as Principal JSON
+//   - HMAC signed token: base64url(Principal JSON) + "." + base64url(HMAC-SHA256)
+type AuthConfig struct {
+	Enabled       bool        `yaml:"Enabled"`
+	Keys          []Principal `yaml:"Keys"`
+	HMACSecret    string      `yaml:"HMACSecret"`
+	SystemAccount string      `yaml:"SystemAccount"`
+}
+
+type Principal struct {
+	Key string `yaml:"Key" json:"-"`
+	// CommonName of verified client certificate. Used if request has no
+	// Authorization header
+	Subject string  `yaml:"Subject" json:"-"`
+	Name    string  `yaml:"Name"`
+	Exp     int64   `yaml:"-"` // unix time, only for tokens
+	Grants  []Grant `yaml:"Grants"`
+}
+
+// Grant allows listed operations on keys with Prefix of the Account
+type Grant struct {
+	Account string   `yaml:"Account"` // * - any account
+	Prefix  string   `yaml:"Prefix"`
+	Perms   []string `yaml:"Perms"` // read | write | lock | watch | admin
+}
+
+func (p *Principal) allowed(acc, key, perm string) bool {
+	for _, g := range p.Grants {
+		if g.Account != "*" && g.Account != acc {
+			continue
+		}
+		if !strings.HasPrefix(key, g.Prefix) {
+			continue
+		}
+		for _, v := range g.Perms {
+			if v == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var apiKeys map[string]*Principal
+var certSubjects map[string]*Principal
+
+func InitAuth() {
+	apiKeys = map[string]*Principal{}
+	certSubjects = map[string]*Principal{}
+	for i, v := range cfg.Auth.Keys {
+		if v.Key != "" {
+			apiKeys[v.Key] = &cfg.Auth.Keys[i]
+		}
+		if v.Subject != "" {
+			certSubjects[v.Subject] = &cfg.Auth.Keys[i]
+		}
+	}
+}
+
+func authenticate(ctx *fasthttp.RequestCtx) (*Principal, error) {
+	h := ctx.Request.Header.Peek("Authorization")
+	if len(h) == 0 && ctx.IsTLS() {
+		// client certificates are already verified during TLS handshake
+		st := tlsState(ctx)
+		if st != nil && len(st.VerifiedChains) > 0 {
+			cn := st.VerifiedChains[0][0].Subject.CommonName
+			if p, ok := certSubjects[cn]; ok {
+				return p, nil
+			}
+			return nil, fmt.Errorf("unknown certificate subject: %v", cn)
+		}
+	}
+	secret, ok := bytes.CutPrefix(h, []byte("Bearer "))
+	if !ok || len(secret) == 0 {
+		return nil, fmt.Errorf("missing credentials")
+	}
+	if p, ok := apiKeys[string(secret)]; ok {
+		return p, nil
+	}
+	if cfg.Auth.HMACSecret != "" {
+		if payload, sig, ok := bytes.Cut(secret, []byte(".")); ok {
+			return verifyToken(payload, sig)
+		}
+	}
+	if cfg.Auth.SystemAccount != "" {
+		v, err := getKV(cfg.Auth.SystemAccount, store.db, "apikeys/"+string(secret))
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			var p Principal
+			err = json.Unmarshal(v.Data, &p)
+			if err != nil {
+				return nil, err
+			}
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid credentials")
+}
+
+func verifyToken(payload, sig []byte) (*Principal, error) {
+	mac := hmac.New(sha256.New, []byte(cfg.Auth.HMACSecret))
+	mac.Write(payload)
+	got, err := base64.RawURLEncoding.DecodeString(string(sig))
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+	d, err := base64.RawURLEncoding.DecodeString(string(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload")
+	}
+	var p Principal
+	err = json.Unmarshal(d, &p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload")
+	}
+	if p.Exp != 0 && p.Exp < time.Now().Unix() {
+		return nil, fmt.Errorf("token expired")
+	}
+	return &p, nil
+}
+
+type access struct {
+	Acc  string
+	Key  string
+	Perm string
+}
+
+// checkAuth writes 401/403 response and returns false if any of the
+// accesses is not allowed. Always true if auth is disabled.
+func checkAuth(ctx *fasthttp.RequestCtx, acl ...access) bool {
+	if !cfg.Auth.Enabled {
+		return true
+	}
+	p, err := authenticate(ctx)
+	if err != nil {
+		writeError(ctx, fmt.Errorf("%w: %v", cd.ErrUnauthorized, err))
+		return false
+	}
+	for _, a := range acl {
+		if !p.allowed(a.Acc, a.Key, a.Perm) {
+			writeError(ctx, fmt.Errorf("%w: %v has no %v access to %v/%v", cd.ErrForbidden, p.Name, a.Perm, a.Acc, a.Key))
+			return false
+		}
+	}
+	return true
+}
+
+func requestACL(acc string, req *Request) []access {
+	var res []access
+	for _, v := range req.KVGet {
+		res = append(res, access{acc, v.Key, PermRead})
+	}
+	for _, v := range req.KVSet {
+		res = append(res, access{acc, v.Key, PermWrite})
+	}
+	for _, v := range req.KVOps {
+		res = append(res, access{acc, v.Key, PermWrite})
+	}
+	for _, v := range req.Atomic {
+		res = append(res, access{acc, v.Key, PermWrite})
+	}
+	if req.LockID != "" {
+		res = append(res, access{acc, req.LockID, PermLock})
+	}
+	if req.UnlockID != "" {
+		res = append(res, access{acc, req.UnlockID, PermLock})
+	}
+	for _, v := range req.Enqueue {
+		res = append(res, access{acc, v.Queue, PermWrite})
+	}
+	for _, v := range req.Publish {
+		res = append(res, access{acc, v.Topic, PermWrite})
+	}
+	return res
+}
@@ -3,14 +3,50 @@ package cd
 import "errors"
 
 const (
-	AtomicPrefix      = 1 // storage for atomic counters
-	VerSequencePrefix = 3 // store increasing version numbers for KV
-	LocksPrefix       = 4 // store lock durations to restore in case of reboot
-	IdempotencyPrefix = 5 // store idempotency keys to deduplicate requests
-	KVPrefix          = 6 // store kv values
+	AtomicPrefix       = 1  // storage for atomic counters
+	VerSequencePrefix  = 3  // store increasing version numbers for KV
+	LocksPrefix        = 4  // store lock durations to restore in case of reboot
+	IdempotencyPrefix  = 5  // store idempotency keys to deduplicate requests
+	KVPrefix           = 6  // store kv values
+	HistoryPrefix      = 7  // store previous versions of kv values
+	IndexDefPrefix     = 8  // store secondary index definitions
+	IndexPrefix        = 9  // store secondary index entries
+	UsagePrefix        = 10 // store resource usage of accounts for quotas
+	QueuePrefix        = 11 // store messages of queues ready for delivery
+	QueueMetaPrefix    = 12 // store length & counter of queues
+	QueueLeasePrefix   = 13 // store dequeued messages till they are acked
+	QueueDelayPrefix   = 14 // store delayed messages till delivery time
+	QueueSchedPrefix   = 15 // index of delayed messages by delivery time
+	TopicPrefix        = 16 // store append-only logs of topics
+	TopicMetaPrefix    = 17 // store last offset of topics
+	TopicGroupPrefix   = 18 // store committed offsets of consumer groups
+	QueueGroupPrefix   = 19 // store head message of queue message groups
+	QueueBacklogPrefix = 20 // store messages waiting for the head of their group
 )
 
-var ErrNotLocked = errors.New("not_locked")
+const (
+	CompressionNone   = 0
+	CompressionSnappy = 1
+	CompressionZstd   = 2
+)
+
+// Error codes returned by API. Wrap them with fmt.Errorf("%w: ...") to
+// add details.
+var (
+	ErrBadRequest         = errors.New("bad_request")
+	ErrNotLocked          = errors.New("not_locked")
+	ErrLockTimeout        = errors.New("lock_timeout")
+	ErrHandleMismatch     = errors.New("handle_mismatch")
+	ErrDuplicateRequest   = errors.New("duplicate_request")
+	ErrPreconditionFailed = errors.New("precondition_failed")
+	ErrQuotaExceeded      = errors.New("quota_exceeded")
+	ErrNotFound           = errors.New("not_found")
+	ErrNoChange           = errors.New("no_change") // watch timed out
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrStopped            = errors.New("stopped")
+	ErrInternal           = errors.New("internal")
+)
 
 //go:generate msgp
 type Lock struct {
@@ -20,11 +56,84 @@ type Lock struct {
 
 //go:generate msgp
 type KV struct {
-	Data    []byte
-	Version int64
+	Data          []byte
+	Version       int64
+	CreateVersion int64  // version at which key was created
+	Created       int64  // unix time
+	Updated       int64  // unix time
+	Writer        string // client-supplied identity of last writer
+	ContentType   string // empty for JSON, otherwise Data is raw bytes
+	Compression   uint8  // compression of Data. 0 - none
+	KeyID         string // ID of master key. Empty - not encrypted
+	DEK           []byte // data encryption key, encrypted with master key
+}
+
+//go:generate msgp
+type KVHistory struct {
+	Data    []byte `msg:"d"`
+	Version int64  `msg:"v"`
+	Time    int64  `msg:"t"` // unix time of the write
+	Deleted bool   `msg:"x"`
+	Writer  string `msg:"w"`
+	Type    string `msg:"c"` // content type, empty for JSON
+	Comp    uint8  `msg:"z"` // compression of Data. 0 - none
+	KeyID   string `msg:"k"` // ID of master key. Empty - not encrypted
+	DEK     []byte `msg:"e"` // data encryption key, encrypted with master key
+}
+
+//go:generate msgp
+type Index struct {
+	Prefix string `msg:"p"`
+	Path   string `msg:"j"`
+	KeyID  string `msg:"k"` // ID of master key. Empty - values are not hashed
+	DEK    []byte `msg:"e"` // key to hash values, encrypted with master key
+}
+
+//go:generate msgp
+type Idempotency struct {
+	Response []byte `msg:"r"` // JSON encoded response of the original request
+	Expires  int64  `msg:"x"` // unix time, record is ignored & removed after it
+	Hash     []byte `msg:"h"` // hash of method, path & body of the original request
+	// accesses of the original request, "perm\x00key". Replay is returned
+	// only to requests that passed the same checks
+	ACL   []string `msg:"a"`
+	Comp  uint8    `msg:"z"` // compression of Response. 0 - none
+	KeyID string   `msg:"k"` // ID of master key. Empty - not encrypted
+	DEK   []byte   `msg:"e"` // data encryption key, encrypted with master key
 }
 
 type QueueMeta struct {
-	Total   int64 // total messages in a queue
-	Counter int64 // id of the last message
+	Total    int64 // total messages in a queue
+	Counter  int64 // id of the last message
+	Inflight int64 // dequeued, but not acked messages
+	Delayed  int64 // messages waiting for delivery time
+	// after MaxDeliveries failed deliveries message is moved to DeadLetter queue
+	MaxDeliveries int
+	DeadLetter    string
+	Priorities    int   // number of priority levels. 0 - plain FIFO queue
+	Version       int64 // incremented when messages become available to consumers
+}
+
+//go:generate msgp
+type QueueMsg struct {
+	Data     []byte `msg:"d"`
+	Enqueued int64  `msg:"t"` // unix time
+	Attempts int    `msg:"a"` // number of deliveries
+	Receipt  int64  `msg:"r"` // handle of the current lease
+	Till     int64  `msg:"l"` // unix time when lease expires
+	Deliver  int64  `msg:"s"` // unix time when delayed message is delivered
+	Reason   string `msg:"f"` // reason of the last failed delivery
+	Source   string `msg:"q"` // queue of dead-lettered message
+	SourceID int64  `msg:"i"` // ID of dead-lettered message in Source queue
+	Priority uint8  `msg:"p"` // higher priority messages are dequeued first
+	Group    string `msg:"g"` // messages of a group are delivered one at a time
+	// group of dead-lettered message in Source queue. Groups are not
+	// enforced in dead-letter queues
+	SourceGroup string `msg:"o"`
+	// priority of dead-lettered message in Source queue. Messages are
+	// stored with priority 0 in dead-letter queues
+	SourcePriority uint8  `msg:"sp"`
+	Comp           uint8  `msg:"z"` // compression of Data. 0 - none
+	KeyID          string `msg:"k"` // ID of master key. Empty - not encrypted
+	DEK            []byte `msg:"e"` // data encryption key, encrypted with master key
 }
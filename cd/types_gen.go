@@ -7,7 +7,7 @@ import (
 )
 
 // DecodeMsg implements msgp.Decodable
-func (z *KV) DecodeMsg(dc *msgp.Reader) (err error) {
+func (z *Idempotency) DecodeMsg(dc *msgp.Reader) (err error) {
 	var field []byte
 	_ = field
 	var zb0001 uint32
@@ -24,16 +24,59 @@ func (z *KV) DecodeMsg(dc *msgp.Reader) (err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
-		case "Data":
-			z.Data, err = dc.ReadBytes(z.Data)
+		case "r":
+			z.Response, err = dc.ReadBytes(z.Response)
 			if err != nil {
-				err = msgp.WrapError(err, "Data")
+				err = msgp.WrapError(err, "Response")
 				return
 			}
-		case "Version":
-			z.Version, err = dc.ReadInt64()
+		case "x":
+			z.Expires, err = dc.ReadInt64()
 			if err != nil {
-				err = msgp.WrapError(err, "Version")
+				err = msgp.WrapError(err, "Expires")
+				return
+			}
+		case "h":
+			z.Hash, err = dc.ReadBytes(z.Hash)
+			if err != nil {
+				err = msgp.WrapError(err, "Hash")
+				return
+			}
+		case "a":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "ACL")
+				return
+			}
+			if cap(z.ACL) >= int(zb0002) {
+				z.ACL = (z.ACL)[:zb0002]
+			} else {
+				z.ACL = make([]string, zb0002)
+			}
+			for za0001 := range z.ACL {
+				z.ACL[za0001], err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "ACL", za0001)
+					return
+				}
+			}
+		case "z":
+			z.Comp, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "Comp")
+				return
+			}
+		case "k":
+			z.KeyID, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, err = dc.ReadBytes(z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
 				return
 			}
 		default:
@@ -48,46 +91,121 @@ func (z *KV) DecodeMsg(dc *msgp.Reader) (err error) {
 }
 
 // EncodeMsg implements msgp.Encodable
-func (z *KV) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 2
-	// write "Data"
-	err = en.Append(0x82, 0xa4, 0x44, 0x61, 0x74, 0x61)
+func (z *Idempotency) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 7
+	// write "r"
+	err = en.Append(0x87, 0xa1, 0x72)
 	if err != nil {
 		return
 	}
-	err = en.WriteBytes(z.Data)
+	err = en.WriteBytes(z.Response)
 	if err != nil {
-		err = msgp.WrapError(err, "Data")
+		err = msgp.WrapError(err, "Response")
 		return
 	}
-	// write "Version"
-	err = en.Append(0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	// write "x"
+	err = en.Append(0xa1, 0x78)
 	if err != nil {
 		return
 	}
-	err = en.WriteInt64(z.Version)
+	err = en.WriteInt64(z.Expires)
+	if err != nil {
+		err = msgp.WrapError(err, "Expires")
+		return
+	}
+	// write "h"
+	err = en.Append(0xa1, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.Hash)
+	if err != nil {
+		err = msgp.WrapError(err, "Hash")
+		return
+	}
+	// write "a"
+	err = en.Append(0xa1, 0x61)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.ACL)))
+	if err != nil {
+		err = msgp.WrapError(err, "ACL")
+		return
+	}
+	for za0001 := range z.ACL {
+		err = en.WriteString(z.ACL[za0001])
+		if err != nil {
+			err = msgp.WrapError(err, "ACL", za0001)
+			return
+		}
+	}
+	// write "z"
+	err = en.Append(0xa1, 0x7a)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.Comp)
+	if err != nil {
+		err = msgp.WrapError(err, "Comp")
+		return
+	}
+	// write "k"
+	err = en.Append(0xa1, 0x6b)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.KeyID)
+	if err != nil {
+		err = msgp.WrapError(err, "KeyID")
+		return
+	}
+	// write "e"
+	err = en.Append(0xa1, 0x65)
 	if err != nil {
-		err = msgp.WrapError(err, "Version")
+		return
+	}
+	err = en.WriteBytes(z.DEK)
+	if err != nil {
+		err = msgp.WrapError(err, "DEK")
 		return
 	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
-func (z *KV) MarshalMsg(b []byte) (o []byte, err error) {
+func (z *Idempotency) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 2
-	// string "Data"
-	o = append(o, 0x82, 0xa4, 0x44, 0x61, 0x74, 0x61)
-	o = msgp.AppendBytes(o, z.Data)
-	// string "Version"
-	o = append(o, 0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
-	o = msgp.AppendInt64(o, z.Version)
+	// map header, size 7
+	// string "r"
+	o = append(o, 0x87, 0xa1, 0x72)
+	o = msgp.AppendBytes(o, z.Response)
+	// string "x"
+	o = append(o, 0xa1, 0x78)
+	o = msgp.AppendInt64(o, z.Expires)
+	// string "h"
+	o = append(o, 0xa1, 0x68)
+	o = msgp.AppendBytes(o, z.Hash)
+	// string "a"
+	o = append(o, 0xa1, 0x61)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.ACL)))
+	for za0001 := range z.ACL {
+		o = msgp.AppendString(o, z.ACL[za0001])
+	}
+	// string "z"
+	o = append(o, 0xa1, 0x7a)
+	o = msgp.AppendUint8(o, z.Comp)
+	// string "k"
+	o = append(o, 0xa1, 0x6b)
+	o = msgp.AppendString(o, z.KeyID)
+	// string "e"
+	o = append(o, 0xa1, 0x65)
+	o = msgp.AppendBytes(o, z.DEK)
 	return
 }
 
 // UnmarshalMsg implements msgp.Unmarshaler
-func (z *KV) UnmarshalMsg(bts []byte) (o []byte, err error) {
+func (z *Idempotency) UnmarshalMsg(bts []byte) (o []byte, err error) {
 	var field []byte
 	_ = field
 	var zb0001 uint32
@@ -104,16 +222,59 @@ func (z *KV) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
-		case "Data":
-			z.Data, bts, err = msgp.ReadBytesBytes(bts, z.Data)
+		case "r":
+			z.Response, bts, err = msgp.ReadBytesBytes(bts, z.Response)
 			if err != nil {
-				err = msgp.WrapError(err, "Data")
+				err = msgp.WrapError(err, "Response")
 				return
 			}
-		case "Version":
-			z.Version, bts, err = msgp.ReadInt64Bytes(bts)
+		case "x":
+			z.Expires, bts, err = msgp.ReadInt64Bytes(bts)
 			if err != nil {
-				err = msgp.WrapError(err, "Version")
+				err = msgp.WrapError(err, "Expires")
+				return
+			}
+		case "h":
+			z.Hash, bts, err = msgp.ReadBytesBytes(bts, z.Hash)
+			if err != nil {
+				err = msgp.WrapError(err, "Hash")
+				return
+			}
+		case "a":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "ACL")
+				return
+			}
+			if cap(z.ACL) >= int(zb0002) {
+				z.ACL = (z.ACL)[:zb0002]
+			} else {
+				z.ACL = make([]string, zb0002)
+			}
+			for za0001 := range z.ACL {
+				z.ACL[za0001], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "ACL", za0001)
+					return
+				}
+			}
+		case "z":
+			z.Comp, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Comp")
+				return
+			}
+		case "k":
+			z.KeyID, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, bts, err = msgp.ReadBytesBytes(bts, z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
 				return
 			}
 		default:
@@ -129,13 +290,17 @@ func (z *KV) UnmarshalMsg(bts []byte) (o []byte, err error) {
 }
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
-func (z *KV) Msgsize() (s int) {
-	s = 1 + 5 + msgp.BytesPrefixSize + len(z.Data) + 8 + msgp.Int64Size
+func (z *Idempotency) Msgsize() (s int) {
+	s = 1 + 2 + msgp.BytesPrefixSize + len(z.Response) + 2 + msgp.Int64Size + 2 + msgp.BytesPrefixSize + len(z.Hash) + 2 + msgp.ArrayHeaderSize
+	for za0001 := range z.ACL {
+		s += msgp.StringPrefixSize + len(z.ACL[za0001])
+	}
+	s += 2 + msgp.Uint8Size + 2 + msgp.StringPrefixSize + len(z.KeyID) + 2 + msgp.BytesPrefixSize + len(z.DEK)
 	return
 }
 
 // DecodeMsg implements msgp.Decodable
-func (z *Lock) DecodeMsg(dc *msgp.Reader) (err error) {
+func (z *Index) DecodeMsg(dc *msgp.Reader) (err error) {
 	var field []byte
 	_ = field
 	var zb0001 uint32
@@ -152,16 +317,28 @@ func (z *Lock) DecodeMsg(dc *msgp.Reader) (err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
-		case "o":
-			z.Handle, err = dc.ReadInt64()
+		case "p":
+			z.Prefix, err = dc.ReadString()
 			if err != nil {
-				err = msgp.WrapError(err, "Handle")
+				err = msgp.WrapError(err, "Prefix")
 				return
 			}
-		case "t":
-			z.Till, err = dc.ReadInt64()
+		case "j":
+			z.Path, err = dc.ReadString()
 			if err != nil {
-				err = msgp.WrapError(err, "Till")
+				err = msgp.WrapError(err, "Path")
+				return
+			}
+		case "k":
+			z.KeyID, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, err = dc.ReadBytes(z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
 				return
 			}
 		default:
@@ -176,46 +353,72 @@ func (z *Lock) DecodeMsg(dc *msgp.Reader) (err error) {
 }
 
 // EncodeMsg implements msgp.Encodable
-func (z Lock) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 2
-	// write "o"
-	err = en.Append(0x82, 0xa1, 0x6f)
+func (z *Index) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 4
+	// write "p"
+	err = en.Append(0x84, 0xa1, 0x70)
 	if err != nil {
 		return
 	}
-	err = en.WriteInt64(z.Handle)
+	err = en.WriteString(z.Prefix)
 	if err != nil {
-		err = msgp.WrapError(err, "Handle")
+		err = msgp.WrapError(err, "Prefix")
 		return
 	}
-	// write "t"
-	err = en.Append(0xa1, 0x74)
+	// write "j"
+	err = en.Append(0xa1, 0x6a)
 	if err != nil {
 		return
 	}
-	err = en.WriteInt64(z.Till)
+	err = en.WriteString(z.Path)
 	if err != nil {
-		err = msgp.WrapError(err, "Till")
+		err = msgp.WrapError(err, "Path")
+		return
+	}
+	// write "k"
+	err = en.Append(0xa1, 0x6b)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.KeyID)
+	if err != nil {
+		err = msgp.WrapError(err, "KeyID")
+		return
+	}
+	// write "e"
+	err = en.Append(0xa1, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.DEK)
+	if err != nil {
+		err = msgp.WrapError(err, "DEK")
 		return
 	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
-func (z Lock) MarshalMsg(b []byte) (o []byte, err error) {
+func (z *Index) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 2
-	// string "o"
-	o = append(o, 0x82, 0xa1, 0x6f)
-	o = msgp.AppendInt64(o, z.Handle)
-	// string "t"
-	o = append(o, 0xa1, 0x74)
-	o = msgp.AppendInt64(o, z.Till)
+	// map header, size 4
+	// string "p"
+	o = append(o, 0x84, 0xa1, 0x70)
+	o = msgp.AppendString(o, z.Prefix)
+	// string "j"
+	o = append(o, 0xa1, 0x6a)
+	o = msgp.AppendString(o, z.Path)
+	// string "k"
+	o = append(o, 0xa1, 0x6b)
+	o = msgp.AppendString(o, z.KeyID)
+	// string "e"
+	o = append(o, 0xa1, 0x65)
+	o = msgp.AppendBytes(o, z.DEK)
 	return
 }
 
 // UnmarshalMsg implements msgp.Unmarshaler
-func (z *Lock) UnmarshalMsg(bts []byte) (o []byte, err error) {
+func (z *Index) UnmarshalMsg(bts []byte) (o []byte, err error) {
 	var field []byte
 	_ = field
 	var zb0001 uint32
@@ -232,16 +435,28 @@ func (z *Lock) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
-		case "o":
-			z.Handle, bts, err = msgp.ReadInt64Bytes(bts)
+		case "p":
+			z.Prefix, bts, err = msgp.ReadStringBytes(bts)
 			if err != nil {
-				err = msgp.WrapError(err, "Handle")
+				err = msgp.WrapError(err, "Prefix")
 				return
 			}
-		case "t":
-			z.Till, bts, err = msgp.ReadInt64Bytes(bts)
+		case "j":
+			z.Path, bts, err = msgp.ReadStringBytes(bts)
 			if err != nil {
-				err = msgp.WrapError(err, "Till")
+				err = msgp.WrapError(err, "Path")
+				return
+			}
+		case "k":
+			z.KeyID, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, bts, err = msgp.ReadBytesBytes(bts, z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
 				return
 			}
 		default:
@@ -257,13 +472,13 @@ func (z *Lock) UnmarshalMsg(bts []byte) (o []byte, err error) {
 }
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
-func (z Lock) Msgsize() (s int) {
-	s = 1 + 2 + msgp.Int64Size + 2 + msgp.Int64Size
+func (z *Index) Msgsize() (s int) {
+	s = 1 + 2 + msgp.StringPrefixSize + len(z.Prefix) + 2 + msgp.StringPrefixSize + len(z.Path) + 2 + msgp.StringPrefixSize + len(z.KeyID) + 2 + msgp.BytesPrefixSize + len(z.DEK)
 	return
 }
 
 // DecodeMsg implements msgp.Decodable
-func (z *QueueMeta) DecodeMsg(dc *msgp.Reader) (err error) {
+func (z *KV) DecodeMsg(dc *msgp.Reader) (err error) {
 	var field []byte
 	_ = field
 	var zb0001 uint32
@@ -280,16 +495,64 @@ func (z *QueueMeta) DecodeMsg(dc *msgp.Reader) (err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
-		case "Total":
-			z.Total, err = dc.ReadInt64()
+		case "Data":
+			z.Data, err = dc.ReadBytes(z.Data)
 			if err != nil {
-				err = msgp.WrapError(err, "Total")
+				err = msgp.WrapError(err, "Data")
 				return
 			}
-		case "Counter":
-			z.Counter, err = dc.ReadInt64()
+		case "Version":
+			z.Version, err = dc.ReadInt64()
 			if err != nil {
-				err = msgp.WrapError(err, "Counter")
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		case "CreateVersion":
+			z.CreateVersion, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "CreateVersion")
+				return
+			}
+		case "Created":
+			z.Created, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Created")
+				return
+			}
+		case "Updated":
+			z.Updated, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Updated")
+				return
+			}
+		case "Writer":
+			z.Writer, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Writer")
+				return
+			}
+		case "ContentType":
+			z.ContentType, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "ContentType")
+				return
+			}
+		case "Compression":
+			z.Compression, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "Compression")
+				return
+			}
+		case "KeyID":
+			z.KeyID, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "DEK":
+			z.DEK, err = dc.ReadBytes(z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
 				return
 			}
 		default:
@@ -304,72 +567,1411 @@ func (z *QueueMeta) DecodeMsg(dc *msgp.Reader) (err error) {
 }
 
 // EncodeMsg implements msgp.Encodable
-func (z QueueMeta) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 2
-	// write "Total"
-	err = en.Append(0x82, 0xa5, 0x54, 0x6f, 0x74, 0x61, 0x6c)
+func (z *KV) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 10
+	// write "Data"
+	err = en.Append(0x8a, 0xa4, 0x44, 0x61, 0x74, 0x61)
 	if err != nil {
 		return
 	}
-	err = en.WriteInt64(z.Total)
+	err = en.WriteBytes(z.Data)
 	if err != nil {
-		err = msgp.WrapError(err, "Total")
+		err = msgp.WrapError(err, "Data")
 		return
 	}
-	// write "Counter"
-	err = en.Append(0xa7, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x65, 0x72)
+	// write "Version"
+	err = en.Append(0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
 	if err != nil {
 		return
 	}
-	err = en.WriteInt64(z.Counter)
+	err = en.WriteInt64(z.Version)
 	if err != nil {
-		err = msgp.WrapError(err, "Counter")
+		err = msgp.WrapError(err, "Version")
 		return
 	}
-	return
-}
-
-// MarshalMsg implements msgp.Marshaler
-func (z QueueMeta) MarshalMsg(b []byte) (o []byte, err error) {
-	o = msgp.Require(b, z.Msgsize())
-	// map header, size 2
-	// string "Total"
-	o = append(o, 0x82, 0xa5, 0x54, 0x6f, 0x74, 0x61, 0x6c)
-	o = msgp.AppendInt64(o, z.Total)
-	// string "Counter"
-	o = append(o, 0xa7, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x65, 0x72)
-	o = msgp.AppendInt64(o, z.Counter)
-	return
-}
-
-// UnmarshalMsg implements msgp.Unmarshaler
-func (z *QueueMeta) UnmarshalMsg(bts []byte) (o []byte, err error) {
-	var field []byte
-	_ = field
-	var zb0001 uint32
-	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	// write "CreateVersion"
+	err = en.Append(0xad, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
 	if err != nil {
-		err = msgp.WrapError(err)
 		return
 	}
-	for zb0001 > 0 {
-		zb0001--
-		field, bts, err = msgp.ReadMapKeyZC(bts)
-		if err != nil {
-			err = msgp.WrapError(err)
-			return
-		}
-		switch msgp.UnsafeString(field) {
-		case "Total":
-			z.Total, bts, err = msgp.ReadInt64Bytes(bts)
-			if err != nil {
-				err = msgp.WrapError(err, "Total")
-				return
-			}
-		case "Counter":
-			z.Counter, bts, err = msgp.ReadInt64Bytes(bts)
-			if err != nil {
-				err = msgp.WrapError(err, "Counter")
+	err = en.WriteInt64(z.CreateVersion)
+	if err != nil {
+		err = msgp.WrapError(err, "CreateVersion")
+		return
+	}
+	// write "Created"
+	err = en.Append(0xa7, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Created)
+	if err != nil {
+		err = msgp.WrapError(err, "Created")
+		return
+	}
+	// write "Updated"
+	err = en.Append(0xa7, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Updated)
+	if err != nil {
+		err = msgp.WrapError(err, "Updated")
+		return
+	}
+	// write "Writer"
+	err = en.Append(0xa6, 0x57, 0x72, 0x69, 0x74, 0x65, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Writer)
+	if err != nil {
+		err = msgp.WrapError(err, "Writer")
+		return
+	}
+	// write "ContentType"
+	err = en.Append(0xab, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.ContentType)
+	if err != nil {
+		err = msgp.WrapError(err, "ContentType")
+		return
+	}
+	// write "Compression"
+	err = en.Append(0xab, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.Compression)
+	if err != nil {
+		err = msgp.WrapError(err, "Compression")
+		return
+	}
+	// write "KeyID"
+	err = en.Append(0xa5, 0x4b, 0x65, 0x79, 0x49, 0x44)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.KeyID)
+	if err != nil {
+		err = msgp.WrapError(err, "KeyID")
+		return
+	}
+	// write "DEK"
+	err = en.Append(0xa3, 0x44, 0x45, 0x4b)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.DEK)
+	if err != nil {
+		err = msgp.WrapError(err, "DEK")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *KV) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 10
+	// string "Data"
+	o = append(o, 0x8a, 0xa4, 0x44, 0x61, 0x74, 0x61)
+	o = msgp.AppendBytes(o, z.Data)
+	// string "Version"
+	o = append(o, 0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	o = msgp.AppendInt64(o, z.Version)
+	// string "CreateVersion"
+	o = append(o, 0xad, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	o = msgp.AppendInt64(o, z.CreateVersion)
+	// string "Created"
+	o = append(o, 0xa7, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64)
+	o = msgp.AppendInt64(o, z.Created)
+	// string "Updated"
+	o = append(o, 0xa7, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64)
+	o = msgp.AppendInt64(o, z.Updated)
+	// string "Writer"
+	o = append(o, 0xa6, 0x57, 0x72, 0x69, 0x74, 0x65, 0x72)
+	o = msgp.AppendString(o, z.Writer)
+	// string "ContentType"
+	o = append(o, 0xab, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65)
+	o = msgp.AppendString(o, z.ContentType)
+	// string "Compression"
+	o = append(o, 0xab, 0x43, 0x6f, 0x6d, 0x70, 0x72, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e)
+	o = msgp.AppendUint8(o, z.Compression)
+	// string "KeyID"
+	o = append(o, 0xa5, 0x4b, 0x65, 0x79, 0x49, 0x44)
+	o = msgp.AppendString(o, z.KeyID)
+	// string "DEK"
+	o = append(o, 0xa3, 0x44, 0x45, 0x4b)
+	o = msgp.AppendBytes(o, z.DEK)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *KV) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Data":
+			z.Data, bts, err = msgp.ReadBytesBytes(bts, z.Data)
+			if err != nil {
+				err = msgp.WrapError(err, "Data")
+				return
+			}
+		case "Version":
+			z.Version, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		case "CreateVersion":
+			z.CreateVersion, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "CreateVersion")
+				return
+			}
+		case "Created":
+			z.Created, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Created")
+				return
+			}
+		case "Updated":
+			z.Updated, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Updated")
+				return
+			}
+		case "Writer":
+			z.Writer, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Writer")
+				return
+			}
+		case "ContentType":
+			z.ContentType, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "ContentType")
+				return
+			}
+		case "Compression":
+			z.Compression, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Compression")
+				return
+			}
+		case "KeyID":
+			z.KeyID, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "DEK":
+			z.DEK, bts, err = msgp.ReadBytesBytes(bts, z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *KV) Msgsize() (s int) {
+	s = 1 + 5 + msgp.BytesPrefixSize + len(z.Data) + 8 + msgp.Int64Size + 14 + msgp.Int64Size + 8 + msgp.Int64Size + 8 + msgp.Int64Size + 7 + msgp.StringPrefixSize + len(z.Writer) + 12 + msgp.StringPrefixSize + len(z.ContentType) + 12 + msgp.Uint8Size + 6 + msgp.StringPrefixSize + len(z.KeyID) + 4 + msgp.BytesPrefixSize + len(z.DEK)
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *KVHistory) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "d":
+			z.Data, err = dc.ReadBytes(z.Data)
+			if err != nil {
+				err = msgp.WrapError(err, "Data")
+				return
+			}
+		case "v":
+			z.Version, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		case "t":
+			z.Time, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Time")
+				return
+			}
+		case "x":
+			z.Deleted, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "Deleted")
+				return
+			}
+		case "w":
+			z.Writer, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Writer")
+				return
+			}
+		case "c":
+			z.Type, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Type")
+				return
+			}
+		case "z":
+			z.Comp, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "Comp")
+				return
+			}
+		case "k":
+			z.KeyID, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, err = dc.ReadBytes(z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *KVHistory) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 9
+	// write "d"
+	err = en.Append(0x89, 0xa1, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.Data)
+	if err != nil {
+		err = msgp.WrapError(err, "Data")
+		return
+	}
+	// write "v"
+	err = en.Append(0xa1, 0x76)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Version)
+	if err != nil {
+		err = msgp.WrapError(err, "Version")
+		return
+	}
+	// write "t"
+	err = en.Append(0xa1, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Time)
+	if err != nil {
+		err = msgp.WrapError(err, "Time")
+		return
+	}
+	// write "x"
+	err = en.Append(0xa1, 0x78)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.Deleted)
+	if err != nil {
+		err = msgp.WrapError(err, "Deleted")
+		return
+	}
+	// write "w"
+	err = en.Append(0xa1, 0x77)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Writer)
+	if err != nil {
+		err = msgp.WrapError(err, "Writer")
+		return
+	}
+	// write "c"
+	err = en.Append(0xa1, 0x63)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Type)
+	if err != nil {
+		err = msgp.WrapError(err, "Type")
+		return
+	}
+	// write "z"
+	err = en.Append(0xa1, 0x7a)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.Comp)
+	if err != nil {
+		err = msgp.WrapError(err, "Comp")
+		return
+	}
+	// write "k"
+	err = en.Append(0xa1, 0x6b)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.KeyID)
+	if err != nil {
+		err = msgp.WrapError(err, "KeyID")
+		return
+	}
+	// write "e"
+	err = en.Append(0xa1, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.DEK)
+	if err != nil {
+		err = msgp.WrapError(err, "DEK")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *KVHistory) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 9
+	// string "d"
+	o = append(o, 0x89, 0xa1, 0x64)
+	o = msgp.AppendBytes(o, z.Data)
+	// string "v"
+	o = append(o, 0xa1, 0x76)
+	o = msgp.AppendInt64(o, z.Version)
+	// string "t"
+	o = append(o, 0xa1, 0x74)
+	o = msgp.AppendInt64(o, z.Time)
+	// string "x"
+	o = append(o, 0xa1, 0x78)
+	o = msgp.AppendBool(o, z.Deleted)
+	// string "w"
+	o = append(o, 0xa1, 0x77)
+	o = msgp.AppendString(o, z.Writer)
+	// string "c"
+	o = append(o, 0xa1, 0x63)
+	o = msgp.AppendString(o, z.Type)
+	// string "z"
+	o = append(o, 0xa1, 0x7a)
+	o = msgp.AppendUint8(o, z.Comp)
+	// string "k"
+	o = append(o, 0xa1, 0x6b)
+	o = msgp.AppendString(o, z.KeyID)
+	// string "e"
+	o = append(o, 0xa1, 0x65)
+	o = msgp.AppendBytes(o, z.DEK)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *KVHistory) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "d":
+			z.Data, bts, err = msgp.ReadBytesBytes(bts, z.Data)
+			if err != nil {
+				err = msgp.WrapError(err, "Data")
+				return
+			}
+		case "v":
+			z.Version, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		case "t":
+			z.Time, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Time")
+				return
+			}
+		case "x":
+			z.Deleted, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Deleted")
+				return
+			}
+		case "w":
+			z.Writer, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Writer")
+				return
+			}
+		case "c":
+			z.Type, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Type")
+				return
+			}
+		case "z":
+			z.Comp, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Comp")
+				return
+			}
+		case "k":
+			z.KeyID, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, bts, err = msgp.ReadBytesBytes(bts, z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *KVHistory) Msgsize() (s int) {
+	s = 1 + 2 + msgp.BytesPrefixSize + len(z.Data) + 2 + msgp.Int64Size + 2 + msgp.Int64Size + 2 + msgp.BoolSize + 2 + msgp.StringPrefixSize + len(z.Writer) + 2 + msgp.StringPrefixSize + len(z.Type) + 2 + msgp.Uint8Size + 2 + msgp.StringPrefixSize + len(z.KeyID) + 2 + msgp.BytesPrefixSize + len(z.DEK)
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *Lock) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "o":
+			z.Handle, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Handle")
+				return
+			}
+		case "t":
+			z.Till, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Till")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z Lock) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 2
+	// write "o"
+	err = en.Append(0x82, 0xa1, 0x6f)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Handle)
+	if err != nil {
+		err = msgp.WrapError(err, "Handle")
+		return
+	}
+	// write "t"
+	err = en.Append(0xa1, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Till)
+	if err != nil {
+		err = msgp.WrapError(err, "Till")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z Lock) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 2
+	// string "o"
+	o = append(o, 0x82, 0xa1, 0x6f)
+	o = msgp.AppendInt64(o, z.Handle)
+	// string "t"
+	o = append(o, 0xa1, 0x74)
+	o = msgp.AppendInt64(o, z.Till)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *Lock) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "o":
+			z.Handle, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Handle")
+				return
+			}
+		case "t":
+			z.Till, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Till")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z Lock) Msgsize() (s int) {
+	s = 1 + 2 + msgp.Int64Size + 2 + msgp.Int64Size
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *QueueMeta) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Total":
+			z.Total, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Total")
+				return
+			}
+		case "Counter":
+			z.Counter, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Counter")
+				return
+			}
+		case "Inflight":
+			z.Inflight, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Inflight")
+				return
+			}
+		case "Delayed":
+			z.Delayed, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Delayed")
+				return
+			}
+		case "MaxDeliveries":
+			z.MaxDeliveries, err = dc.ReadInt()
+			if err != nil {
+				err = msgp.WrapError(err, "MaxDeliveries")
+				return
+			}
+		case "DeadLetter":
+			z.DeadLetter, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "DeadLetter")
+				return
+			}
+		case "Priorities":
+			z.Priorities, err = dc.ReadInt()
+			if err != nil {
+				err = msgp.WrapError(err, "Priorities")
+				return
+			}
+		case "Version":
+			z.Version, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *QueueMeta) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 8
+	// write "Total"
+	err = en.Append(0x88, 0xa5, 0x54, 0x6f, 0x74, 0x61, 0x6c)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Total)
+	if err != nil {
+		err = msgp.WrapError(err, "Total")
+		return
+	}
+	// write "Counter"
+	err = en.Append(0xa7, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x65, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Counter)
+	if err != nil {
+		err = msgp.WrapError(err, "Counter")
+		return
+	}
+	// write "Inflight"
+	err = en.Append(0xa8, 0x49, 0x6e, 0x66, 0x6c, 0x69, 0x67, 0x68, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Inflight)
+	if err != nil {
+		err = msgp.WrapError(err, "Inflight")
+		return
+	}
+	// write "Delayed"
+	err = en.Append(0xa7, 0x44, 0x65, 0x6c, 0x61, 0x79, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Delayed)
+	if err != nil {
+		err = msgp.WrapError(err, "Delayed")
+		return
+	}
+	// write "MaxDeliveries"
+	err = en.Append(0xad, 0x4d, 0x61, 0x78, 0x44, 0x65, 0x6c, 0x69, 0x76, 0x65, 0x72, 0x69, 0x65, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt(z.MaxDeliveries)
+	if err != nil {
+		err = msgp.WrapError(err, "MaxDeliveries")
+		return
+	}
+	// write "DeadLetter"
+	err = en.Append(0xaa, 0x44, 0x65, 0x61, 0x64, 0x4c, 0x65, 0x74, 0x74, 0x65, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.DeadLetter)
+	if err != nil {
+		err = msgp.WrapError(err, "DeadLetter")
+		return
+	}
+	// write "Priorities"
+	err = en.Append(0xaa, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x69, 0x65, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt(z.Priorities)
+	if err != nil {
+		err = msgp.WrapError(err, "Priorities")
+		return
+	}
+	// write "Version"
+	err = en.Append(0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Version)
+	if err != nil {
+		err = msgp.WrapError(err, "Version")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *QueueMeta) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 8
+	// string "Total"
+	o = append(o, 0x88, 0xa5, 0x54, 0x6f, 0x74, 0x61, 0x6c)
+	o = msgp.AppendInt64(o, z.Total)
+	// string "Counter"
+	o = append(o, 0xa7, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x65, 0x72)
+	o = msgp.AppendInt64(o, z.Counter)
+	// string "Inflight"
+	o = append(o, 0xa8, 0x49, 0x6e, 0x66, 0x6c, 0x69, 0x67, 0x68, 0x74)
+	o = msgp.AppendInt64(o, z.Inflight)
+	// string "Delayed"
+	o = append(o, 0xa7, 0x44, 0x65, 0x6c, 0x61, 0x79, 0x65, 0x64)
+	o = msgp.AppendInt64(o, z.Delayed)
+	// string "MaxDeliveries"
+	o = append(o, 0xad, 0x4d, 0x61, 0x78, 0x44, 0x65, 0x6c, 0x69, 0x76, 0x65, 0x72, 0x69, 0x65, 0x73)
+	o = msgp.AppendInt(o, z.MaxDeliveries)
+	// string "DeadLetter"
+	o = append(o, 0xaa, 0x44, 0x65, 0x61, 0x64, 0x4c, 0x65, 0x74, 0x74, 0x65, 0x72)
+	o = msgp.AppendString(o, z.DeadLetter)
+	// string "Priorities"
+	o = append(o, 0xaa, 0x50, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x69, 0x65, 0x73)
+	o = msgp.AppendInt(o, z.Priorities)
+	// string "Version"
+	o = append(o, 0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	o = msgp.AppendInt64(o, z.Version)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *QueueMeta) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Total":
+			z.Total, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Total")
+				return
+			}
+		case "Counter":
+			z.Counter, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Counter")
+				return
+			}
+		case "Inflight":
+			z.Inflight, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Inflight")
+				return
+			}
+		case "Delayed":
+			z.Delayed, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Delayed")
+				return
+			}
+		case "MaxDeliveries":
+			z.MaxDeliveries, bts, err = msgp.ReadIntBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "MaxDeliveries")
+				return
+			}
+		case "DeadLetter":
+			z.DeadLetter, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "DeadLetter")
+				return
+			}
+		case "Priorities":
+			z.Priorities, bts, err = msgp.ReadIntBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Priorities")
+				return
+			}
+		case "Version":
+			z.Version, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *QueueMeta) Msgsize() (s int) {
+	s = 1 + 6 + msgp.Int64Size + 8 + msgp.Int64Size + 9 + msgp.Int64Size + 8 + msgp.Int64Size + 14 + msgp.IntSize + 11 + msgp.StringPrefixSize + len(z.DeadLetter) + 11 + msgp.IntSize + 8 + msgp.Int64Size
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *QueueMsg) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "d":
+			z.Data, err = dc.ReadBytes(z.Data)
+			if err != nil {
+				err = msgp.WrapError(err, "Data")
+				return
+			}
+		case "t":
+			z.Enqueued, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Enqueued")
+				return
+			}
+		case "a":
+			z.Attempts, err = dc.ReadInt()
+			if err != nil {
+				err = msgp.WrapError(err, "Attempts")
+				return
+			}
+		case "r":
+			z.Receipt, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Receipt")
+				return
+			}
+		case "l":
+			z.Till, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Till")
+				return
+			}
+		case "s":
+			z.Deliver, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "Deliver")
+				return
+			}
+		case "f":
+			z.Reason, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Reason")
+				return
+			}
+		case "q":
+			z.Source, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Source")
+				return
+			}
+		case "i":
+			z.SourceID, err = dc.ReadInt64()
+			if err != nil {
+				err = msgp.WrapError(err, "SourceID")
+				return
+			}
+		case "p":
+			z.Priority, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "Priority")
+				return
+			}
+		case "g":
+			z.Group, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Group")
+				return
+			}
+		case "o":
+			z.SourceGroup, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "SourceGroup")
+				return
+			}
+		case "sp":
+			z.SourcePriority, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "SourcePriority")
+				return
+			}
+		case "z":
+			z.Comp, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "Comp")
+				return
+			}
+		case "k":
+			z.KeyID, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, err = dc.ReadBytes(z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *QueueMsg) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 16
+	// write "d"
+	err = en.Append(0xde, 0x0, 0x10, 0xa1, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.Data)
+	if err != nil {
+		err = msgp.WrapError(err, "Data")
+		return
+	}
+	// write "t"
+	err = en.Append(0xa1, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Enqueued)
+	if err != nil {
+		err = msgp.WrapError(err, "Enqueued")
+		return
+	}
+	// write "a"
+	err = en.Append(0xa1, 0x61)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt(z.Attempts)
+	if err != nil {
+		err = msgp.WrapError(err, "Attempts")
+		return
+	}
+	// write "r"
+	err = en.Append(0xa1, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Receipt)
+	if err != nil {
+		err = msgp.WrapError(err, "Receipt")
+		return
+	}
+	// write "l"
+	err = en.Append(0xa1, 0x6c)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Till)
+	if err != nil {
+		err = msgp.WrapError(err, "Till")
+		return
+	}
+	// write "s"
+	err = en.Append(0xa1, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.Deliver)
+	if err != nil {
+		err = msgp.WrapError(err, "Deliver")
+		return
+	}
+	// write "f"
+	err = en.Append(0xa1, 0x66)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Reason)
+	if err != nil {
+		err = msgp.WrapError(err, "Reason")
+		return
+	}
+	// write "q"
+	err = en.Append(0xa1, 0x71)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Source)
+	if err != nil {
+		err = msgp.WrapError(err, "Source")
+		return
+	}
+	// write "i"
+	err = en.Append(0xa1, 0x69)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.SourceID)
+	if err != nil {
+		err = msgp.WrapError(err, "SourceID")
+		return
+	}
+	// write "p"
+	err = en.Append(0xa1, 0x70)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.Priority)
+	if err != nil {
+		err = msgp.WrapError(err, "Priority")
+		return
+	}
+	// write "g"
+	err = en.Append(0xa1, 0x67)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Group)
+	if err != nil {
+		err = msgp.WrapError(err, "Group")
+		return
+	}
+	// write "o"
+	err = en.Append(0xa1, 0x6f)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.SourceGroup)
+	if err != nil {
+		err = msgp.WrapError(err, "SourceGroup")
+		return
+	}
+	// write "sp"
+	err = en.Append(0xa2, 0x73, 0x70)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.SourcePriority)
+	if err != nil {
+		err = msgp.WrapError(err, "SourcePriority")
+		return
+	}
+	// write "z"
+	err = en.Append(0xa1, 0x7a)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.Comp)
+	if err != nil {
+		err = msgp.WrapError(err, "Comp")
+		return
+	}
+	// write "k"
+	err = en.Append(0xa1, 0x6b)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.KeyID)
+	if err != nil {
+		err = msgp.WrapError(err, "KeyID")
+		return
+	}
+	// write "e"
+	err = en.Append(0xa1, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.DEK)
+	if err != nil {
+		err = msgp.WrapError(err, "DEK")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *QueueMsg) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 16
+	// string "d"
+	o = append(o, 0xde, 0x0, 0x10, 0xa1, 0x64)
+	o = msgp.AppendBytes(o, z.Data)
+	// string "t"
+	o = append(o, 0xa1, 0x74)
+	o = msgp.AppendInt64(o, z.Enqueued)
+	// string "a"
+	o = append(o, 0xa1, 0x61)
+	o = msgp.AppendInt(o, z.Attempts)
+	// string "r"
+	o = append(o, 0xa1, 0x72)
+	o = msgp.AppendInt64(o, z.Receipt)
+	// string "l"
+	o = append(o, 0xa1, 0x6c)
+	o = msgp.AppendInt64(o, z.Till)
+	// string "s"
+	o = append(o, 0xa1, 0x73)
+	o = msgp.AppendInt64(o, z.Deliver)
+	// string "f"
+	o = append(o, 0xa1, 0x66)
+	o = msgp.AppendString(o, z.Reason)
+	// string "q"
+	o = append(o, 0xa1, 0x71)
+	o = msgp.AppendString(o, z.Source)
+	// string "i"
+	o = append(o, 0xa1, 0x69)
+	o = msgp.AppendInt64(o, z.SourceID)
+	// string "p"
+	o = append(o, 0xa1, 0x70)
+	o = msgp.AppendUint8(o, z.Priority)
+	// string "g"
+	o = append(o, 0xa1, 0x67)
+	o = msgp.AppendString(o, z.Group)
+	// string "o"
+	o = append(o, 0xa1, 0x6f)
+	o = msgp.AppendString(o, z.SourceGroup)
+	// string "sp"
+	o = append(o, 0xa2, 0x73, 0x70)
+	o = msgp.AppendUint8(o, z.SourcePriority)
+	// string "z"
+	o = append(o, 0xa1, 0x7a)
+	o = msgp.AppendUint8(o, z.Comp)
+	// string "k"
+	o = append(o, 0xa1, 0x6b)
+	o = msgp.AppendString(o, z.KeyID)
+	// string "e"
+	o = append(o, 0xa1, 0x65)
+	o = msgp.AppendBytes(o, z.DEK)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *QueueMsg) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "d":
+			z.Data, bts, err = msgp.ReadBytesBytes(bts, z.Data)
+			if err != nil {
+				err = msgp.WrapError(err, "Data")
+				return
+			}
+		case "t":
+			z.Enqueued, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Enqueued")
+				return
+			}
+		case "a":
+			z.Attempts, bts, err = msgp.ReadIntBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Attempts")
+				return
+			}
+		case "r":
+			z.Receipt, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Receipt")
+				return
+			}
+		case "l":
+			z.Till, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Till")
+				return
+			}
+		case "s":
+			z.Deliver, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Deliver")
+				return
+			}
+		case "f":
+			z.Reason, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Reason")
+				return
+			}
+		case "q":
+			z.Source, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Source")
+				return
+			}
+		case "i":
+			z.SourceID, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "SourceID")
+				return
+			}
+		case "p":
+			z.Priority, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Priority")
+				return
+			}
+		case "g":
+			z.Group, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Group")
+				return
+			}
+		case "o":
+			z.SourceGroup, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "SourceGroup")
+				return
+			}
+		case "sp":
+			z.SourcePriority, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "SourcePriority")
+				return
+			}
+		case "z":
+			z.Comp, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Comp")
+				return
+			}
+		case "k":
+			z.KeyID, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeyID")
+				return
+			}
+		case "e":
+			z.DEK, bts, err = msgp.ReadBytesBytes(bts, z.DEK)
+			if err != nil {
+				err = msgp.WrapError(err, "DEK")
 				return
 			}
 		default:
@@ -385,7 +1987,7 @@ func (z *QueueMeta) UnmarshalMsg(bts []byte) (o []byte, err error) {
 }
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
-func (z QueueMeta) Msgsize() (s int) {
-	s = 1 + 6 + msgp.Int64Size + 8 + msgp.Int64Size
+func (z *QueueMsg) Msgsize() (s int) {
+	s = 3 + 2 + msgp.BytesPrefixSize + len(z.Data) + 2 + msgp.Int64Size + 2 + msgp.IntSize + 2 + msgp.Int64Size + 2 + msgp.Int64Size + 2 + msgp.Int64Size + 2 + msgp.StringPrefixSize + len(z.Reason) + 2 + msgp.StringPrefixSize + len(z.Source) + 2 + msgp.Int64Size + 2 + msgp.Uint8Size + 2 + msgp.StringPrefixSize + len(z.Group) + 2 + msgp.StringPrefixSize + len(z.SourceGroup) + 3 + msgp.Uint8Size + 2 + msgp.Uint8Size + 2 + msgp.StringPrefixSize + len(z.KeyID) + 2 + msgp.BytesPrefixSize + len(z.DEK)
 	return
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type CompressionConfig struct {
+	Algo    string `yaml:"Algo"`    // snappy | zstd. Empty - disabled
+	MinSize int    `yaml:"MinSize"` // compress only values larger than this
+}
+
+// encoder & decoder are safe for concurrent use with EncodeAll/DecodeAll
+var zstdEnc, _ = zstd.NewWriter(nil)
+var zstdDec, _ = zstd.NewReader(nil)
+
+// compress returns compressed data and compression marker to store
+// alongside it. Values below threshold are returned as is.
+func compress(data []byte) ([]byte, uint8) {
+	if len(data) == 0 || len(data) < cfg.Compression.MinSize {
+		return data, cd.CompressionNone
+	}
+	var res []byte
+	var c uint8
+	switch cfg.Compression.Algo {
+	case "snappy":
+		res, c = snappy.Encode(nil, data), cd.CompressionSnappy
+	case "zstd":
+		res, c = zstdEnc.EncodeAll(data, nil), cd.CompressionZstd
+	default:
+		return data, cd.CompressionNone
+	}
+	if len(res) >= len(data) { // not compressible
+		return data, cd.CompressionNone
+	}
+	return res, c
+}
+
+func decompress(data []byte, c uint8) ([]byte, error) {
+	switch c {
+	case cd.CompressionNone:
+		return data, nil
+	case cd.CompressionSnappy:
+		return snappy.Decode(nil, data)
+	case cd.CompressionZstd:
+		return zstdDec.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression: %v", c)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Messages that failed MaxDeliveries times are moved to dead-letter queue
+// of the same account, so they don't block processing of other messages.
+// Dead-letter queue is a regular queue, its messages remember source queue,
+// ID and the reason of the last failure. Dead-lettered messages get the
+// default priority in dead-letter queue and restore theirs on redrive.
+type QueuePolicy struct {
+	MaxDeliveries int    // 0 - unlimited
+	DeadLetter    string // required if MaxDeliveries is set
+	Priorities    int    // number of priority levels. 0 - plain FIFO queue
+}
+
+func setQueuePolicy(acc, queue string, p QueuePolicy) error {
+	if p.MaxDeliveries < 0 {
+		return fmt.Errorf("MaxDeliveries can't be negative")
+	}
+	if p.MaxDeliveries > 0 {
+		err := validQueue(p.DeadLetter)
+		if err != nil {
+			return fmt.Errorf("bad dead-letter queue: %w", err)
+		}
+		if p.DeadLetter == queue {
+			return fmt.Errorf("queue can't be dead-letter queue of itself")
+		}
+	}
+	if p.Priorities < 0 || p.Priorities > 256 {
+		return fmt.Errorf("Priorities is not in range 0~256")
+	}
+	return store.Singleton([]byte(acc), func() error {
+		b := store.db.NewBatch()
+		meta, err := getQueueMeta(acc, store.db, queue)
+		if err != nil {
+			return err
+		}
+		// keys of messages depend on priority mode
+		if (meta.Priorities == 0) != (p.Priorities == 0) && meta.Total+meta.Inflight+meta.Delayed > 0 {
+			return fmt.Errorf("priority mode of non-empty queue can't be changed")
+		}
+		meta.MaxDeliveries, meta.DeadLetter, meta.Priorities = p.MaxDeliveries, p.DeadLetter, p.Priorities
+		err = setQueueMeta(acc, b, queue, meta)
+		if err != nil {
+			return err
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	})
+}
+
+// deadLetter enqueues failed message m to dlq and returns new version of dlq
+func deadLetter(acc string, b *pebble.Batch, queue string, id int64, m *cd.QueueMsg, dlq string) (int64, error) {
+	meta, err := getQueueMeta(acc, b, dlq)
+	if err != nil {
+		return 0, err
+	}
+	meta.Counter++
+	meta.Total++
+	meta.Version++
+	m.Source, m.SourceID = queue, id
+	m.SourceGroup, m.Group = m.Group, ""
+	m.SourcePriority, m.Priority = m.Priority, 0
+	d, err := m.MarshalMsg(nil)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	err = b.Set(readyMsgID(acc, dlq, &meta, 0, meta.Counter), d, pebble.NoSync)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return meta.Version, setQueueMeta(acc, b, dlq, meta)
+}
+
+type DeadLetterMsg struct {
+	ID       int64
+	Data     json.RawMessage `json:",omitempty"`
+	Enqueued int64           // unix time of original enqueue
+	Attempts int
+	Reason   string
+	Source   string
+	SourceID int64
+	Priority int `json:",omitempty"` // priority in the source queue
+}
+
+func newDeadLetterMsg(key []byte, m *cd.QueueMsg, withData bool) (DeadLetterMsg, error) {
+	res := DeadLetterMsg{
+		ID:       queueMsgSeq(key),
+		Enqueued: m.Enqueued,
+		Attempts: m.Attempts,
+		Reason:   m.Reason,
+		Source:   m.Source,
+		SourceID: m.SourceID,
+		Priority: int(m.SourcePriority),
+	}
+	if withData {
+		d, err := queueMsgData(m)
+		if err != nil {
+			return res, err
+		}
+		res.Data = d
+	}
+	return res, nil
+}
+
+// listDeadLetters returns messages of dlq without data, starting after ID
+func listDeadLetters(acc, dlq string, after int64, limit int) ([]DeadLetterMsg, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	meta, err := getQueueMeta(acc, store.db, dlq)
+	if err != nil {
+		return nil, err
+	}
+	opts := queueBounds(cd.QueuePrefix, acc, dlq)
+	opts.LowerBound = readyMsgID(acc, dlq, &meta, 0, after+1)
+	iter, err := store.db.NewIter(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	res := []DeadLetterMsg{}
+	for iter.First(); iter.Valid() && len(res) < limit; iter.Next() {
+		var m cd.QueueMsg
+		_, err := m.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		v, err := newDeadLetterMsg(iter.Key(), &m, false)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func inspectDeadLetters(acc, dlq string, ids []int64) ([]DeadLetterMsg, error) {
+	meta, err := getQueueMeta(acc, store.db, dlq)
+	if err != nil {
+		return nil, err
+	}
+	res := []DeadLetterMsg{}
+	for _, id := range ids {
+		key := readyMsgID(acc, dlq, &meta, 0, id)
+		d, closer, err := store.db.Get(key)
+		if err == pebble.ErrNotFound {
+			return nil, fmt.Errorf("%w: message %v", cd.ErrNotFound, id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		var m cd.QueueMsg
+		_, err = m.UnmarshalMsg(d)
+		closer.Close()
+		if err != nil {
+			return nil, err
+		}
+		v, err := newDeadLetterMsg(key, &m, true)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// redriveDeadLetters returns messages back to their source queues (redrive)
+// or deletes them. Empty ids - all messages of dlq. Messages without source
+// queue are left in place by redrive.
+func redriveDeadLetters(acc, dlq string, ids []int64, redrive bool) (int, error) {
+	notify := map[string]int64{}
+	count := 0
+	err := store.Singleton([]byte(acc), func() error {
+		b := store.db.NewIndexedBatch()
+		meta, err := getQueueMeta(acc, b, dlq)
+		if err != nil {
+			return err
+		}
+		var keys [][]byte
+		if len(ids) == 0 {
+			iter, err := store.db.NewIter(queueBounds(cd.QueuePrefix, acc, dlq))
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			for iter.First(); iter.Valid(); iter.Next() {
+				keys = append(keys, append([]byte{}, iter.Key()...))
+			}
+			err = iter.Close()
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+		}
+		for _, id := range ids {
+			keys = append(keys, readyMsgID(acc, dlq, &meta, 0, id))
+		}
+		for _, key := range keys {
+			d, closer, err := b.Get(key)
+			if err == pebble.ErrNotFound {
+				return fmt.Errorf("%w: message %v", cd.ErrNotFound, queueMsgSeq(key))
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			var m cd.QueueMsg
+			_, err = m.UnmarshalMsg(d)
+			closer.Close()
+			if err != nil {
+				return err
+			}
+			if redrive && m.Source == "" {
+				continue // not dead-lettered, nowhere to return it
+			}
+			err = b.Delete(key, pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			meta.Total--
+			count++
+			if !redrive {
+				err = addMsgUsage(acc, b, &m, -1)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			// back to its original place in the source queue
+			source := m.Source
+			src, err := getQueueMeta(acc, b, source)
+			if err != nil {
+				return err
+			}
+			id := m.SourceID
+			m.Attempts, m.Reason, m.Source, m.SourceID = 0, "", "", 0
+			m.Group, m.SourceGroup = m.SourceGroup, ""
+			m.Priority, m.SourcePriority = m.SourcePriority, 0
+			if levels := max(src.Priorities, 1); int(m.Priority) >= levels {
+				m.Priority = uint8(levels - 1) // source policy was changed
+			}
+			d, err = m.MarshalMsg(nil)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			err = readyMsg(acc, b, source, id, &m, d, &src)
+			if err != nil {
+				return err
+			}
+			src.Total++
+			src.Version++
+			err = setQueueMeta(acc, b, source, src)
+			if err != nil {
+				return err
+			}
+			notify[source] = src.Version
+		}
+		err = setQueueMeta(acc, b, dlq, meta)
+		if err != nil {
+			return err
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for q, ver := range notify {
+		store.notifier(acc).NotifyVersion(queueWatchKey(q), ver)
+	}
+	return count, nil
+}
+
+type DeadLetterRequest struct {
+	Queue  string  // dead-letter queue
+	Action string  // list | inspect | redrive | purge
+	IDs    []int64 // messages to inspect, redrive or purge. Empty - all
+	After  int64   // list messages with ID greater than After
+	Limit  int
+}
+
+type DeadLetterRes struct {
+	Messages []DeadLetterMsg `json:"msgs,omitempty"`
+	Count    int             `json:"count,omitempty"` // redriven or purged messages
+}
+
+func DeadLetterHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var req DeadLetterRequest
+	err = json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	err = validQueue(req.Queue)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if !checkAuth(ctx, access{acc, req.Queue, PermAdmin}) {
+		return
+	}
+	var res DeadLetterRes
+	switch req.Action {
+	case "list":
+		res.Messages, err = listDeadLetters(acc, req.Queue, req.After, req.Limit)
+	case "inspect":
+		res.Messages, err = inspectDeadLetters(acc, req.Queue, req.IDs)
+	case "redrive", "purge":
+		res.Count, err = redriveDeadLetters(acc, req.Queue, req.IDs, req.Action == "redrive")
+	default:
+		err = fmt.Errorf("unknown action: %v", req.Action)
+	}
+	writeJSON(ctx, res, err)
+}
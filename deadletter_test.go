@@ -0,0 +1,143 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"errors"
+	"testing"
+)
+
+// failAll dequeues & nacks messages of the queue till they are dead-lettered
+func failAll(t *testing.T, acc, queue string, rounds int) {
+	t.Helper()
+	for i := 0; i < rounds; i++ {
+		ms := mustDequeue(t, acc, queue, 10, 30)
+		var nack []string
+		for _, m := range ms {
+			nack = append(nack, m.Receipt)
+		}
+		if len(nack) > 0 {
+			mustSettle(t, acc, QueueRequest{Queue: queue, Nack: nack, Reason: "boom"})
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	acc := "t_dlq"
+	err := setQueuePolicy(acc, "q", QueuePolicy{MaxDeliveries: 2, DeadLetter: "dlq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a")})
+	failAll(t, acc, "q", 2)
+	expectMeta(t, acc, "q", 0, 0, 0)
+	expectMeta(t, acc, "dlq", 1, 0, 0)
+	res, err := inspectDeadLetters(acc, "dlq", []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := res[0]
+	if m.Source != "q" || m.SourceID != 1 || m.Attempts != 2 || m.Reason != "boom" {
+		t.Fatalf("unexpected dead letter %+v", m)
+	}
+
+	n, err := redriveDeadLetters(acc, "dlq", []int64{1}, true)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 redriven message, got %v, %v", n, err)
+	}
+	expectMeta(t, acc, "dlq", 0, 0, 0)
+	ms := mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1)
+	if ms[0].Attempts != 1 {
+		t.Fatalf("expected attempts to be reset, got %v", ms[0].Attempts)
+	}
+}
+
+func TestDeadLetterPurge(t *testing.T) {
+	acc := "t_dlq_purge"
+	err := setQueuePolicy(acc, "q", QueuePolicy{MaxDeliveries: 1, DeadLetter: "dlq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a", "b")})
+	failAll(t, acc, "q", 1)
+	n, err := redriveDeadLetters(acc, "dlq", nil, false)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 purged messages, got %v, %v", n, err)
+	}
+	expectMeta(t, acc, "dlq", 0, 0, 0)
+	expectMeta(t, acc, "q", 0, 0, 0)
+	_, err = inspectDeadLetters(acc, "dlq", []int64{1})
+	if !errors.Is(err, cd.ErrNotFound) {
+		t.Fatalf("expected not_found for purged message, got %v", err)
+	}
+}
+
+func TestRedriveSkipsOwnMessages(t *testing.T) {
+	acc := "t_redrive_own"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a")})
+	n, err := redriveDeadLetters(acc, "q", nil, true)
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing to redrive, got %v, %v", n, err)
+	}
+	expectMeta(t, acc, "q", 1, 0, 0)
+}
+
+func TestDeadLetterGroup(t *testing.T) {
+	acc := "t_dlq_group"
+	err := setQueuePolicy(acc, "q", QueuePolicy{MaxDeliveries: 1, DeadLetter: "dlq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "g", Messages: msgs("g1", "g2", "g3")})
+	// dead-lettered head releases the group
+	failAll(t, acc, "q", 1)
+	ms := mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 2)
+
+	// redriven message waits for the current head of its group
+	_, err = redriveDeadLetters(acc, "dlq", []int64{1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30))
+	mustSettle(t, acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt}})
+	ms = mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1)
+	if ms[0].Group != "g" {
+		t.Fatalf("expected message to return to group g, got %q", ms[0].Group)
+	}
+	mustSettle(t, acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt}})
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 3)
+}
+
+func TestDeadLetterPriority(t *testing.T) {
+	acc := "t_dlq_prio"
+	err := setQueuePolicy(acc, "dlq", QueuePolicy{Priorities: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setQueuePolicy(acc, "q", QueuePolicy{Priorities: 3, MaxDeliveries: 1, DeadLetter: "dlq"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Priority: 2, Messages: msgs("a")})
+	failAll(t, acc, "q", 1)
+	// consumed & nacked in dead-letter queue - still found by ID
+	failAll(t, acc, "dlq", 1)
+	res, err := inspectDeadLetters(acc, "dlq", []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Priority != 2 {
+		t.Fatalf("expected source priority 2, got %v", res[0].Priority)
+	}
+	_, err = redriveDeadLetters(acc, "dlq", []int64{1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1)
+	if ms[0].Priority != 2 {
+		t.Fatalf("expected priority 2 after redrive, got %v", ms[0].Priority)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Delayed messages are kept out of the queue till their delivery time.
+// Scheduler loop moves due messages into the queue, keeping their IDs.
+//
+// TableID|Account|0|Queue|0|ID(big endian)             ->  cd.QueueMsg
+// TableID|Deliver(big endian)|Account|0|Queue|0|ID     ->  nil
+//
+// Time index is shared by all accounts, so scheduler needs a single
+// iterator to find due messages. Entries of deleted or cancelled
+// messages are removed by scheduler.
+func schedID(at int64, acc, queue string, id int64) []byte {
+	b := binary.BigEndian.AppendUint64([]byte{cd.QueueSchedPrefix}, uint64(at))
+	b = append(b, acc...)
+	b = append(b, 0)
+	b = append(b, queue...)
+	b = append(b, 0)
+	return binary.BigEndian.AppendUint64(b, uint64(id))
+}
+
+func parseSchedID(key []byte) (int64, string, string, int64) {
+	at := int64(binary.BigEndian.Uint64(key[1:9]))
+	// skip time, so the rest of the key looks like message key
+	acc, queue, id := parseQueueMsgID(key[8:])
+	return at, acc, queue, id
+}
+
+// delayMsg stores encoded message m till m.Deliver time
+func delayMsg(acc string, b *pebble.Batch, queue string, id int64, m *cd.QueueMsg, meta *cd.QueueMeta) error {
+	d, err := m.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	err = b.Set(queueMsgID(cd.QueueDelayPrefix, acc, queue, id), d, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	meta.Delayed++
+	err = b.Set(schedID(m.Deliver, acc, queue, id), nil, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return nil
+}
+
+func delayedMsg(acc string, r pebble.Reader, queue string, id int64) (*cd.QueueMsg, error) {
+	d, closer, err := r.Get(queueMsgID(cd.QueueDelayPrefix, acc, queue, id))
+	if err == pebble.ErrNotFound {
+		return nil, fmt.Errorf("%w: message %v is not delayed", cd.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer closer.Close()
+	var m cd.QueueMsg
+	_, err = m.UnmarshalMsg(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return &m, nil
+}
+
+func cancelDelayed(acc string, b *pebble.Batch, queue string, id int64, meta *cd.QueueMeta) error {
+	m, err := delayedMsg(acc, b, queue, id)
+	if err != nil {
+		return err
+	}
+	err = releaseGroup(acc, b, queue, id, m, meta)
+	if err != nil {
+		return err
+	}
+	err = b.Delete(queueMsgID(cd.QueueDelayPrefix, acc, queue, id), pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	meta.Delayed--
+	err = b.Delete(schedID(m.Deliver, acc, queue, id), pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return addMsgUsage(acc, b, m, -1)
+}
+
+// SchedulerLoop delivers delayed messages when their time comes.
+func SchedulerLoop(ctx context.Context) {
+	for {
+		n, err := deliverDelayed(time.Now().Unix())
+		if err != nil {
+			log.Print("delivery of delayed messages failed: ", err)
+		}
+		if err == nil && n == 1000 {
+			continue // there could be more due messages
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// deliverDelayed moves up to 1000 due messages to their queues and
+// returns number of processed time index entries.
+func deliverDelayed(now int64) (int, error) {
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{cd.QueueSchedPrefix},
+		UpperBound: binary.BigEndian.AppendUint64([]byte{cd.QueueSchedPrefix}, uint64(now+1)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	// group by account, to deliver all messages of account at once
+	due := map[string][][]byte{}
+	n := 0
+	for iter.First(); iter.Valid() && n < 1000; iter.Next() {
+		_, acc, _, _ := parseSchedID(iter.Key())
+		due[acc] = append(due[acc], append([]byte{}, iter.Key()...))
+		n++
+	}
+	err = iter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	for acc, keys := range due {
+		err := deliverAccDelayed(acc, keys)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func deliverAccDelayed(acc string, keys [][]byte) error {
+	notify := map[string]int64{}
+	err := store.Singleton([]byte(acc), func() error {
+		b := store.db.NewIndexedBatch()
+		metas := map[string]*cd.QueueMeta{}
+		for _, key := range keys {
+			err := b.Delete(key, pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			at, _, queue, id := parseSchedID(key)
+			m, err := delayedMsg(acc, b, queue, id)
+			if errors.Is(err, cd.ErrNotFound) {
+				continue // cancelled or account deleted
+			}
+			if err != nil {
+				return err
+			}
+			if m.Deliver != at {
+				continue
+			}
+			meta, ok := metas[queue]
+			if !ok {
+				v, err := getQueueMeta(acc, b, queue)
+				if err != nil {
+					return err
+				}
+				meta = &v
+				metas[queue] = meta
+			}
+			err = b.Delete(queueMsgID(cd.QueueDelayPrefix, acc, queue, id), pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			m.Deliver = 0
+			d, err := m.MarshalMsg(nil)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			err = readyMsg(acc, b, queue, id, m, d, meta)
+			if err != nil {
+				return err
+			}
+			meta.Delayed--
+			meta.Total++
+		}
+		for queue, meta := range metas {
+			meta.Version++
+			notify[queue] = meta.Version
+			err := setQueueMeta(acc, b, queue, *meta)
+			if err != nil {
+				return err
+			}
+		}
+		err := b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for queue, ver := range notify {
+		store.notifier(acc).NotifyVersion(queueWatchKey(queue), ver)
+	}
+	return nil
+}
+
+// indexDelayed adds delayed messages of the account to the time index.
+// Used after account is copied.
+func indexDelayed(acc string) error {
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: compID(cd.QueueDelayPrefix, acc, ""),
+		UpperBound: accUpperBound(cd.QueueDelayPrefix, acc),
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	b := store.db.NewBatch()
+	for iter.First(); iter.Valid(); iter.Next() {
+		var m cd.QueueMsg
+		_, err := m.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		_, queue, id := parseQueueMsgID(iter.Key())
+		err = b.Set(schedID(m.Deliver, acc, queue, id), nil, pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+	}
+	err = b.Commit(pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Values are encrypted with random per-value data key (DEK) and DEK itself
+// is encrypted with master key (KEK). ID of the master key is stored next
+// to the value, so master keys can be rotated by re-encrypting only DEKs.
+//
+// Keys are configured as "id:base64(32 bytes)" separated by commas or new lines.
+type EncryptionConfig struct {
+	KeysFile  string `yaml:"KeysFile"`
+	KeysEnv   string `yaml:"KeysEnv"`   // name of env variable with keys
+	ActiveKey string `yaml:"ActiveKey"` // key used for new writes. Empty - disabled
+	// how often to look for values encrypted with old keys (or not encrypted
+	// at all) and re-encrypt them with active key. Default 1h
+	RotateInterval time.Duration `yaml:"RotateInterval"`
+}
+
+var masterKeys = map[string]cipher.AEAD{}
+
+func InitEncryption() error {
+	c := cfg.Encryption
+	var keys []string
+	if c.KeysFile != "" {
+		d, err := os.ReadFile(c.KeysFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, strings.FieldsFunc(string(d), isKeySep)...)
+	}
+	if c.KeysEnv != "" {
+		keys = append(keys, strings.FieldsFunc(os.Getenv(c.KeysEnv), isKeySep)...)
+	}
+	for _, v := range keys {
+		id, k, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok {
+			return fmt.Errorf("bad encryption key format, expected id:base64")
+		}
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return fmt.Errorf("bad encryption key %v: %v", id, err)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return fmt.Errorf("bad encryption key %v: %v", id, err)
+		}
+		masterKeys[id] = aead
+	}
+	if c.ActiveKey != "" && masterKeys[c.ActiveKey] == nil {
+		return fmt.Errorf("active encryption key %v not found", c.ActiveKey)
+	}
+	return nil
+}
+
+func isKeySep(r rune) bool {
+	return r == ',' || r == '\n'
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func seal(aead cipher.AEAD, data []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func unseal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, data[:n], data[n:], nil)
+}
+
+// encrypt returns ID of master key, encrypted DEK and encrypted data.
+// Data is returned as is if encryption is disabled.
+func encrypt(data []byte) (string, []byte, []byte) {
+	id := cfg.Encryption.ActiveKey
+	if id == "" {
+		return "", nil, data
+	}
+	dek := make([]byte, 32)
+	_, err := rand.Read(dek)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		panic(err)
+	}
+	return id, seal(masterKeys[id], dek), seal(aead, data)
+}
+
+func decrypt(id string, dek, data []byte) ([]byte, error) {
+	if id == "" {
+		return data, nil
+	}
+	kek, ok := masterKeys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %v not found", id)
+	}
+	rawDEK, err := unseal(kek, dek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(rawDEK)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(aead, data)
+}
+
+// newDataKey returns random key and the key encrypted with active master
+// key. Empty ID - encryption is disabled.
+func newDataKey() ([]byte, string, []byte) {
+	id := cfg.Encryption.ActiveKey
+	if id == "" {
+		return nil, "", nil
+	}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return key, id, seal(masterKeys[id], key)
+}
+
+func openDataKey(id string, dek []byte) ([]byte, error) {
+	kek, ok := masterKeys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %v not found", id)
+	}
+	return unseal(kek, dek)
+}
+
+// reencrypt re-wraps DEK with active master key. Not encrypted data is
+// encrypted completely.
+func reencrypt(id string, dek, data []byte) (string, []byte, []byte, error) {
+	if id == "" {
+		nid, ndek, ndata := encrypt(data)
+		return nid, ndek, ndata, nil
+	}
+	kek, ok := masterKeys[id]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("encryption key %v not found", id)
+	}
+	rawDEK, err := unseal(kek, dek)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	active := cfg.Encryption.ActiveKey
+	return active, seal(masterKeys[active], rawDEK), data, nil
+}
+
+// RotationLoop periodically re-encrypts values that were encrypted with
+// a key other than active one.
+func RotationLoop(ctx context.Context) {
+	if cfg.Encryption.ActiveKey == "" {
+		return
+	}
+	d := cfg.Encryption.RotateInterval
+	if d == 0 {
+		d = time.Hour
+	}
+	for {
+		n, err := encryptIndexes()
+		if err != nil {
+			log.Print("encryption of plain indexes failed: ", err)
+		}
+		if n > 0 {
+			log.Printf("re-built %v indexes with plain values", n)
+			err = store.db.Compact([]byte{cd.IndexPrefix}, []byte{cd.IndexPrefix + 1}, true)
+			if err != nil {
+				log.Print("compaction after index encryption failed: ", err)
+			}
+		}
+		for _, t := range []byte{cd.KVPrefix, cd.HistoryPrefix, cd.QueuePrefix, cd.QueueLeasePrefix, cd.QueueDelayPrefix, cd.QueueBacklogPrefix, cd.TopicPrefix, cd.IdempotencyPrefix, cd.IndexDefPrefix} {
+			n, err := rotateTable(t)
+			if err != nil {
+				log.Print("key rotation failed: ", err)
+			}
+			if n > 0 {
+				log.Printf("re-encrypted %v records of table %v", n, t)
+				// rewrite sstables, so that old versions are removed from disk
+				err = store.db.Compact([]byte{t}, []byte{t + 1}, true)
+				if err != nil {
+					log.Print("compaction after key rotation failed: ", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+func rotateTable(t byte) (int, error) {
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{t},
+		UpperBound: []byte{t + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		id, err := recordKeyID(t, iter.Value())
+		if err != nil {
+			return count, err
+		}
+		if id == cfg.Encryption.ActiveKey {
+			continue
+		}
+		key := append([]byte{}, iter.Key()...)
+		acc, _, _ := strings.Cut(string(key[1:]), string([]byte{0}))
+		// re-read record under account lock, so we won't overwrite
+		// concurrent update
+		err = store.Singleton([]byte(acc), func() error {
+			d, closer, err := store.db.Get(key)
+			if err == pebble.ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			nd, err := rotateRecord(t, d)
+			closer.Close()
+			if err != nil {
+				return err
+			}
+			return store.db.Set(key, nd, pebble.NoSync)
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func recordKeyID(t byte, d []byte) (string, error) {
+	switch t {
+	case cd.KVPrefix:
+		var v cd.KV
+		_, err := v.UnmarshalMsg(d)
+		return v.KeyID, err
+	case cd.QueuePrefix, cd.QueueLeasePrefix, cd.QueueDelayPrefix, cd.QueueBacklogPrefix, cd.TopicPrefix:
+		var v cd.QueueMsg
+		_, err := v.UnmarshalMsg(d)
+		return v.KeyID, err
+	case cd.IdempotencyPrefix:
+		var v cd.Idempotency
+		_, err := v.UnmarshalMsg(d)
+		return v.KeyID, err
+	case cd.IndexDefPrefix:
+		var v cd.Index
+		_, err := v.UnmarshalMsg(d)
+		if v.KeyID == "" { // index with plain values is re-built by encryptIndexes
+			return cfg.Encryption.ActiveKey, err
+		}
+		return v.KeyID, err
+	}
+	var v cd.KVHistory
+	_, err := v.UnmarshalMsg(d)
+	return v.KeyID, err
+}
+
+func rotateRecord(t byte, d []byte) ([]byte, error) {
+	var err error
+	switch t {
+	case cd.KVPrefix:
+		var v cd.KV
+		_, err = v.UnmarshalMsg(d)
+		if err != nil {
+			return nil, err
+		}
+		v.KeyID, v.DEK, v.Data, err = reencrypt(v.KeyID, v.DEK, v.Data)
+		if err != nil {
+			return nil, err
+		}
+		return v.MarshalMsg(nil)
+	case cd.QueuePrefix, cd.QueueLeasePrefix, cd.QueueDelayPrefix, cd.QueueBacklogPrefix, cd.TopicPrefix:
+		var v cd.QueueMsg
+		_, err = v.UnmarshalMsg(d)
+		if err != nil {
+			return nil, err
+		}
+		v.KeyID, v.DEK, v.Data, err = reencrypt(v.KeyID, v.DEK, v.Data)
+		if err != nil {
+			return nil, err
+		}
+		return v.MarshalMsg(nil)
+	case cd.IdempotencyPrefix:
+		var v cd.Idempotency
+		_, err = v.UnmarshalMsg(d)
+		if err != nil {
+			return nil, err
+		}
+		v.KeyID, v.DEK, v.Response, err = reencrypt(v.KeyID, v.DEK, v.Response)
+		if err != nil {
+			return nil, err
+		}
+		return v.MarshalMsg(nil)
+	case cd.IndexDefPrefix:
+		var v cd.Index
+		_, err = v.UnmarshalMsg(d)
+		if err != nil {
+			return nil, err
+		}
+		// hash key stays the same, so index entries are still valid
+		v.KeyID, v.DEK, _, err = reencrypt(v.KeyID, v.DEK, nil)
+		if err != nil {
+			return nil, err
+		}
+		return v.MarshalMsg(nil)
+	}
+	var v cd.KVHistory
+	_, err = v.UnmarshalMsg(d)
+	if err != nil {
+		return nil, err
+	}
+	v.KeyID, v.DEK, v.Data, err = reencrypt(v.KeyID, v.DEK, v.Data)
+	if err != nil {
+		return nil, err
+	}
+	return v.MarshalMsg(nil)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"errors"
+
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// ErrorResponse is returned for all failed requests, so that clients
+// can rely on Code instead of parsing error messages.
+type ErrorResponse struct {
+	Code  string
+	Error string
+}
+
+var errStatuses = []struct {
+	err    error
+	status int
+}{
+	{cd.ErrDuplicateRequest, 409},
+	{cd.ErrHandleMismatch, 409},
+	{cd.ErrPreconditionFailed, 412},
+	{cd.ErrNotLocked, 423},
+	{cd.ErrLockTimeout, 423},
+	{cd.ErrQuotaExceeded, 429},
+	{cd.ErrStopped, 503},
+	{cd.ErrInternal, 500},
+	{cd.ErrNotFound, 404},
+	{cd.ErrNoChange, 408}, // 304 can't have a body
+	{cd.ErrUnauthorized, 401},
+	{cd.ErrForbidden, 403},
+}
+
+// errCode returns code & http status of the error.
+// Errors without code are considered to be caused by bad request.
+func errCode(err error) (string, int) {
+	for _, v := range errStatuses {
+		if errors.Is(err, v.err) {
+			return v.err.Error(), v.status
+		}
+	}
+	return cd.ErrBadRequest.Error(), 400
+}
+
+func writeError(ctx *fasthttp.RequestCtx, err error) {
+	code, status := errCode(err)
+	d, _ := json.Marshal(ErrorResponse{
+		Code:  code,
+		Error: err.Error(),
+	})
+	ctx.Response.Reset()
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.Response.SetBody(d)
+}
@@ -6,6 +6,8 @@ require (
 	github.com/buaazp/fasthttprouter v0.1.1
 	github.com/cockroachdb/pebble v1.1.0
 	github.com/goccy/go-json v0.9.11
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.15.15
 	github.com/lafikl/hlc v0.0.0-20170703083803-0610e7fd8181
 	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.22
@@ -26,8 +28,6 @@ require (
 	github.com/getsentry/sentry-go v0.18.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/golang/snappy v0.0.4 // indirect
-	github.com/klauspost/compress v1.15.15 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.2-0.20181231171920-c182affec369 // indirect
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// HistoryRule enables retention of previous versions for keys of the account
+// that start with Prefix. First matching rule is used.
+type HistoryRule struct {
+	Account  string        `yaml:"Account"`  // empty - any account
+	Prefix   string        `yaml:"Prefix"`   // empty - any key
+	Versions int           `yaml:"Versions"` // keep last N versions. 0 - no limit
+	Duration time.Duration `yaml:"Duration"` // keep versions for T. 0 - no limit
+}
+
+func historyRule(acc, key string) *HistoryRule {
+	for i, r := range cfg.History {
+		if r.Account != "" && r.Account != acc {
+			continue
+		}
+		if strings.HasPrefix(key, r.Prefix) {
+			return &cfg.History[i]
+		}
+	}
+	return nil
+}
+
+// TableID|Account|0|Key|0|Version(big endian)
+// big endian is used to iterate versions in order
+func historyID(acc, key string, ver int64) []byte {
+	b := compID(cd.HistoryPrefix, acc, key)
+	b = append(b, 0)
+	return binary.BigEndian.AppendUint64(b, uint64(ver))
+}
+
+func historyBounds(acc, key string) *pebble.IterOptions {
+	b := compID(cd.HistoryPrefix, acc, key)
+	return &pebble.IterOptions{
+		LowerBound: append(b, 0),
+		UpperBound: append(b[:len(b):len(b)], 1),
+	}
+}
+
+// saveHistory writes version to history and removes versions that are
+// out of retention. No-op if key has no history rule.
+func saveHistory(acc string, b *pebble.Batch, v *KV) error {
+	key := v.Key
+	r := historyRule(acc, key)
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	h := cd.KVHistory{
+		Data:    v.Value,
+		Version: v.Version,
+		Time:    now.Unix(),
+		Deleted: v.Delete,
+		Writer:  v.Writer,
+		Type:    v.ContentType,
+	}
+	h.Data, h.Comp = compress(h.Data)
+	h.KeyID, h.DEK, h.Data = encrypt(h.Data)
+	d, err := h.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	err = b.Set(historyID(acc, key, v.Version), d, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	if r.Versions == 0 && r.Duration == 0 {
+		return nil
+	}
+	iter, err := b.NewIter(historyBounds(acc, key))
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	count := 0
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		count++
+		if r.Versions != 0 && count > r.Versions {
+			break
+		}
+		if r.Duration != 0 {
+			var old cd.KVHistory
+			_, err := old.UnmarshalMsg(iter.Value())
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			if now.Sub(time.Unix(old.Time, 0)) > r.Duration {
+				break
+			}
+		}
+	}
+	// everything older than current position is out of retention
+	for ; iter.Valid(); iter.Prev() {
+		err := b.Delete(iter.Key(), pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+	}
+	return nil
+}
+
+// HistorySweepLoop removes versions older than Duration of their rule.
+// saveHistory trims them only when the key is written again.
+func HistorySweepLoop(ctx context.Context) {
+	for {
+		n, err := sweepHistory()
+		if err != nil {
+			log.Print("history sweep failed: ", err)
+		}
+		if n > 0 {
+			log.Printf("removed %v expired history versions", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func sweepHistory() (int, error) {
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{cd.HistoryPrefix},
+		UpperBound: []byte{cd.HistoryPrefix + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	now := time.Now()
+	count := 0
+	// versions are never re-created, so they are removed without lock
+	b := store.db.NewBatch()
+	flush := func() error {
+		if b.Empty() {
+			return nil
+		}
+		err := b.Commit(pebble.NoSync)
+		b = store.db.NewBatch()
+		return err
+	}
+	for iter.First(); iter.Valid(); {
+		k := iter.Key()
+		a, rest, _ := bytes.Cut(k[1:], []byte{0})
+		if len(rest) < 9 {
+			iter.Next()
+			continue
+		}
+		acc, key := string(a), string(rest[:len(rest)-9])
+		r := historyRule(acc, key)
+		if r != nil && r.Duration != 0 {
+			var h cd.KVHistory
+			_, err := h.UnmarshalMsg(iter.Value())
+			if err != nil {
+				return count, err
+			}
+			if now.Sub(time.Unix(h.Time, 0)) > r.Duration {
+				err = b.Delete(k, pebble.NoSync)
+				if err != nil {
+					return count, err
+				}
+				count++
+				if b.Count() == 1000 {
+					err = flush()
+					if err != nil {
+						return count, err
+					}
+				}
+				iter.Next()
+				continue
+			}
+		}
+		// versions are ordered by time, the rest of the key is kept
+		iter.SeekGE(historyBounds(acc, key).UpperBound)
+	}
+	return count, flush()
+}
+
+func getHistory(acc string, b pebble.Reader, key string, ver int64) (*cd.KVHistory, error) {
+	d, closer, err := b.Get(historyID(acc, key, ver))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer closer.Close()
+	return decodeHistory(d)
+}
+
+func decodeHistory(d []byte) (*cd.KVHistory, error) {
+	var h cd.KVHistory
+	_, err := h.UnmarshalMsg(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	h.Data, err = decrypt(h.KeyID, h.DEK, h.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	h.KeyID, h.DEK = "", nil
+	h.Data, err = decompress(h.Data, h.Comp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	h.Comp = cd.CompressionNone
+	return &h, nil
+}
+
+type HistoryRequest struct {
+	Key    string
+	Before int64 // return versions older than this one. 0 - from latest
+	Limit  int
+}
+
+type HistoryRecord struct {
+	Version int64
+	Time    int64
+	Deleted bool   `json:",omitempty"`
+	Writer  string `json:",omitempty"`
+	Type    string `json:",omitempty"` // content type of raw value
+	Value   json.RawMessage
+}
+
+func listHistory(acc string, req HistoryRequest) ([]HistoryRecord, error) {
+	if req.Limit <= 0 || req.Limit > 1000 {
+		req.Limit = 100
+	}
+	opts := historyBounds(acc, req.Key)
+	if req.Before > 0 {
+		opts.UpperBound = historyID(acc, req.Key, req.Before)
+	}
+	iter, err := store.db.NewIter(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	res := []HistoryRecord{}
+	for iter.Last(); iter.Valid() && len(res) < req.Limit; iter.Prev() {
+		h, err := decodeHistory(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, HistoryRecord{
+			Version: h.Version,
+			Time:    h.Time,
+			Deleted: h.Deleted,
+			Writer:  h.Writer,
+			Type:    h.Type,
+			Value:   jsonValue(h.Data, h.Type),
+		})
+	}
+	return res, nil
+}
+
+func HistoryHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var req HistoryRequest
+	err = json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if req.Key == "" {
+		writeError(ctx, fmt.Errorf("key is empty"))
+		return
+	}
+	if !checkAuth(ctx, access{acc, req.Key, PermRead}) {
+		return
+	}
+	err = allowRequest(acc)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	res, err := listHistory(acc, req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	d, err := json.Marshal(res)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	ctx.Response.SetBody(d)
+}
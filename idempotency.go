@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Idempotency records store response of the request, so that client
+// that retries the request (i.e. after timeout) gets the same response
+// instead of applying the request twice.
+//
+// TableID|Account|0|IdempotencyID  ->  cd.Idempotency
+//
+// Records expire after TTL and are removed by IdempotencySweepLoop.
+type IdempotencyConfig struct {
+	TTL           time.Duration            `yaml:"TTL"`           // default 24h
+	Accounts      map[string]time.Duration `yaml:"Accounts"`      // overrides TTL
+	SweepInterval time.Duration            `yaml:"SweepInterval"` // default 1m
+}
+
+func idempotencyTTL(acc string, reqTTL int) time.Duration {
+	if reqTTL > 0 {
+		return time.Duration(reqTTL) * time.Second
+	}
+	if ttl, ok := cfg.Idempotency.Accounts[acc]; ok {
+		return ttl
+	}
+	if cfg.Idempotency.TTL > 0 {
+		return cfg.Idempotency.TTL
+	}
+	return 24 * time.Hour
+}
+
+// requestHash hashes method, path & body of the request. Idempotency id
+// can't be reused for a request with a different hash.
+func requestHash(ctx *fasthttp.RequestCtx) []byte {
+	h := sha256.New()
+	h.Write(ctx.Method())
+	h.Write([]byte{0})
+	h.Write(ctx.Path())
+	h.Write([]byte{0})
+	h.Write(ctx.Request.Body())
+	return h.Sum(nil)
+}
+
+// idempotencyKeys adds key from Idempotency-Key header to idempotency ids
+// of the request and hashes the request.
+func idempotencyKeys(ctx *fasthttp.RequestCtx, req *Request) {
+	k := ctx.Request.Header.Peek("Idempotency-Key")
+	if len(k) > 0 {
+		req.IdempotencyIDs = append(req.IdempotencyIDs, string(k))
+	}
+	if len(req.IdempotencyIDs) == 0 {
+		return
+	}
+	req.reqHash = requestHash(ctx)
+}
+
+// idempotencyACL returns accesses of the request as "perm\x00key"
+func idempotencyACL(acc string, req *Request) []string {
+	return aclStrings(requestACL(acc, req))
+}
+
+func aclStrings(acl []access) []string {
+	var res []string
+	for _, a := range acl {
+		res = append(res, a.Perm+"\x00"+a.Key)
+	}
+	return res
+}
+
+// idemKey is idempotency of /queue & /topic requests, which have only
+// Idempotency-Key header. nil - request is not idempotent.
+type idemKey struct {
+	id   string
+	hash []byte
+	acl  []string
+}
+
+func headerIdempotency(ctx *fasthttp.RequestCtx, acl ...access) *idemKey {
+	k := ctx.Request.Header.Peek("Idempotency-Key")
+	if len(k) == 0 {
+		return nil
+	}
+	return &idemKey{id: string(k), hash: requestHash(ctx), acl: aclStrings(acl)}
+}
+
+// get reads stored response into res. false - request was not handled yet.
+func (k *idemKey) get(acc string, r pebble.Reader, res interface{}) (bool, error) {
+	if k == nil {
+		return false, nil
+	}
+	return loadIdempotency(acc, r, []string{k.id}, k.hash, k.acl, res)
+}
+
+func (k *idemKey) save(acc string, b *pebble.Batch, res interface{}) error {
+	if k == nil {
+		return nil
+	}
+	return storeIdempotency(acc, b, []string{k.id}, k.hash, 0, k.acl, res)
+}
+
+// getIdempotency returns stored response of the request with any of
+// its idempotency ids. nil - request was not handled yet.
+func getIdempotency(acc string, r pebble.Reader, req *Request) (*Response, error) {
+	if len(req.IdempotencyIDs) == 0 {
+		return nil, nil
+	}
+	var res Response
+	ok, err := loadIdempotency(acc, r, req.IdempotencyIDs, req.reqHash, idempotencyACL(acc, req), &res)
+	if !ok || err != nil {
+		return nil, err
+	}
+	res.Replay = true
+	return &res, nil
+}
+
+// saveIdempotency stores response in the same batch as effects of
+// the request.
+func saveIdempotency(acc string, b *pebble.Batch, req *Request, res *Response) error {
+	if len(req.IdempotencyIDs) == 0 {
+		return nil
+	}
+	return storeIdempotency(acc, b, req.IdempotencyIDs, req.reqHash, req.IdempotencyTTL, idempotencyACL(acc, req), res)
+}
+
+func loadIdempotency(acc string, r pebble.Reader, ids []string, hash []byte, acl []string, res interface{}) (bool, error) {
+	for _, id := range ids {
+		d, closer, err := r.Get(compID(cd.IdempotencyPrefix, acc, id))
+		if err == pebble.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		var rec cd.Idempotency
+		_, err = rec.UnmarshalMsg(d)
+		closer.Close()
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		if rec.Expires < time.Now().Unix() { // not swept yet
+			continue
+		}
+		if !bytes.Equal(rec.Hash, hash) {
+			return false, fmt.Errorf("%w: idempotency key %v is used by a different request", cd.ErrDuplicateRequest, id)
+		}
+		// current request passed auth checks, so it's enough to make sure
+		// that it has all accesses of the original one
+		cur := map[string]bool{}
+		for _, a := range acl {
+			cur[a] = true
+		}
+		for _, a := range rec.ACL {
+			if !cur[a] {
+				return false, fmt.Errorf("%w: idempotency key %v is used by a request with different access", cd.ErrForbidden, id)
+			}
+		}
+		d, err = decrypt(rec.KeyID, rec.DEK, rec.Response)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		d, err = decompress(d, rec.Comp)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = json.Unmarshal(d, res)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func storeIdempotency(acc string, b *pebble.Batch, ids []string, hash []byte, ttl int, acl []string, res interface{}) error {
+	d, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	rec := cd.Idempotency{
+		Expires: time.Now().Add(idempotencyTTL(acc, ttl)).Unix(),
+		Hash:    hash,
+		ACL:     acl,
+	}
+	// response may contain values of KVGet & KVOps or messages
+	d, rec.Comp = compress(d)
+	rec.KeyID, rec.DEK, rec.Response = encrypt(d)
+	v, err := rec.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	for _, id := range ids {
+		err := b.Set(compID(cd.IdempotencyPrefix, acc, id), v, pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+	}
+	return nil
+}
+
+// IdempotencySweepLoop periodically removes expired idempotency records.
+func IdempotencySweepLoop(ctx context.Context) {
+	d := cfg.Idempotency.SweepInterval
+	if d == 0 {
+		d = time.Minute
+	}
+	for {
+		n, err := sweepIdempotency()
+		if err != nil {
+			log.Print("idempotency sweep failed: ", err)
+		}
+		if n > 0 {
+			log.Printf("removed %v expired idempotency records", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+func sweepIdempotency() (int, error) {
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{cd.IdempotencyPrefix},
+		UpperBound: []byte{cd.IdempotencyPrefix + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	now := time.Now().Unix()
+	count := 0
+	var acc []byte
+	var expired [][]byte
+	flush := func() error {
+		if len(expired) == 0 {
+			return nil
+		}
+		n, err := deleteExpiredIdempotency(string(acc), expired, now)
+		count += n
+		expired = expired[:0]
+		return err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		var rec cd.Idempotency
+		_, err := rec.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return count, err
+		}
+		if rec.Expires >= now {
+			continue
+		}
+		k := iter.Key()
+		a, _, _ := bytes.Cut(k[1:], []byte{0})
+		if !bytes.Equal(a, acc) || len(expired) == 1000 {
+			err := flush()
+			if err != nil {
+				return count, err
+			}
+			acc = append(acc[:0], a...)
+		}
+		expired = append(expired, append([]byte{}, k...))
+	}
+	err = flush()
+	return count, err
+}
+
+// deleteExpiredIdempotency re-checks records under account lock, so that
+// record re-created by concurrent request is not removed.
+func deleteExpiredIdempotency(acc string, keys [][]byte, now int64) (int, error) {
+	count := 0
+	err := store.Singleton([]byte(acc), func() error {
+		b := store.db.NewBatch()
+		for _, k := range keys {
+			d, closer, err := store.db.Get(k)
+			if err == pebble.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var rec cd.Idempotency
+			_, err = rec.UnmarshalMsg(d)
+			closer.Close()
+			if err != nil {
+				return err
+			}
+			if rec.Expires >= now {
+				continue
+			}
+			err = b.Delete(k, pebble.NoSync)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return b.Commit(pebble.NoSync)
+	})
+	return count, err
+}
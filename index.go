@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Secondary indexes on JSON fields of KV values.
+// Index entries are written in the same batch as the value itself, so
+// index is always consistent with the data.
+//
+// TableID|Account|0|IndexName|0|EncodedValue|0|Key  ->  Key
+//
+// Indexes created with encryption enabled store keyed HMAC of the value
+// instead of the value itself, so they support only exact match queries.
+type IndexDef struct {
+	Name   string
+	Prefix string // index only keys with this prefix, i.e. orders/
+	Path   string // JSONPath of the indexed field, i.e. $.status
+	path   jsonPath
+	mac    []byte // key to hash values. nil - values are stored as is
+}
+
+// in-memory copy of index definitions, to avoid reading them on every write
+var idxMu sync.RWMutex
+var indexes = map[string][]IndexDef{}
+
+func InitIndexes() {
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{cd.IndexDefPrefix},
+		UpperBound: []byte{cd.IndexDefPrefix + 1},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		acc, name, _ := strings.Cut(fromCompID1(iter.Key()), string([]byte{0}))
+		var v cd.Index
+		_, err := v.UnmarshalMsg(iter.Value())
+		if err != nil {
+			panic(err)
+		}
+		path, err := parseJSONPath(v.Path)
+		if err != nil {
+			panic(err)
+		}
+		var mac []byte
+		if v.KeyID != "" {
+			mac, err = openDataKey(v.KeyID, v.DEK)
+			if err != nil {
+				panic(fmt.Errorf("index %v of %v: %w", name, acc, err))
+			}
+		}
+		indexes[acc] = append(indexes[acc], IndexDef{
+			Name:   name,
+			Prefix: v.Prefix,
+			Path:   v.Path,
+			path:   path,
+			mac:    mac,
+		})
+	}
+}
+
+func accIndexes(acc string) []IndexDef {
+	idxMu.RLock()
+	defer idxMu.RUnlock()
+	return indexes[acc]
+}
+
+// encodeIndexValue encodes JSON scalar, so that byte order of encoded
+// values matches order of values: null < false < true < numbers < strings
+func encodeIndexValue(d json.RawMessage) ([]byte, bool) {
+	v, err := decodeJSON(d)
+	if err != nil {
+		return nil, false
+	}
+	switch t := v.(type) {
+	case nil:
+		return []byte{1}, true
+	case bool:
+		if t {
+			return []byte{3}, true
+		}
+		return []byte{2}, true
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return nil, false
+		}
+		bits := math.Float64bits(f)
+		if f >= 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return binary.BigEndian.AppendUint64([]byte{4}, bits), true
+	case string:
+		return append([]byte{5}, t...), true
+	}
+	return nil, false // objects & arrays are not indexed
+}
+
+// encode returns encoded value of the index entry
+func (idx *IndexDef) encode(d json.RawMessage) ([]byte, bool) {
+	v, ok := encodeIndexValue(d)
+	if !ok || idx.mac == nil {
+		return v, ok
+	}
+	h := hmac.New(sha256.New, idx.mac)
+	h.Write(v)
+	return append([]byte{6}, h.Sum(nil)...), true
+}
+
+// extract returns encoded value of the indexed field of the document.
+// Documents without the field are not indexed, unlike explicit null.
+func (idx *IndexDef) extract(data []byte) ([]byte, bool) {
+	d := idx.path.Extract(data)
+	if d == nil {
+		return nil, false
+	}
+	return idx.encode(d)
+}
+
+func getIndex(acc, name string) (*IndexDef, bool) {
+	for _, v := range accIndexes(acc) {
+		if v.Name == name {
+			return &v, true
+		}
+	}
+	return nil, false
+}
+
+func indexPrefix(acc, name string) []byte {
+	b := compID(cd.IndexPrefix, acc, name)
+	return append(b, 0)
+}
+
+func indexEntryID(acc, name string, val []byte, key string) []byte {
+	b := indexPrefix(acc, name)
+	b = append(b, val...)
+	b = append(b, 0)
+	return append(b, key...)
+}
+
+// updateIndexes replaces index entries of the old value with entries for
+// the new one. new == nil - value is deleted.
+func updateIndexes(acc string, b *pebble.Batch, key string, old, new []byte) error {
+	for _, idx := range accIndexes(acc) {
+		if !strings.HasPrefix(key, idx.Prefix) {
+			continue
+		}
+		if old != nil {
+			if ov, ok := idx.extract(old); ok {
+				err := b.Delete(indexEntryID(acc, idx.Name, ov, key), pebble.NoSync)
+				if err != nil {
+					return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+				}
+			}
+		}
+		if new != nil {
+			if nv, ok := idx.extract(new); ok {
+				err := b.Set(indexEntryID(acc, idx.Name, nv, key), []byte(key), pebble.NoSync)
+				if err != nil {
+					return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func createIndex(acc string, def IndexDef) error {
+	if def.Name == "" || strings.IndexByte(def.Name, 0) != -1 {
+		return fmt.Errorf("bad index name")
+	}
+	path, err := parseJSONPath(def.Path)
+	if err != nil {
+		return err
+	}
+	def.path = path
+	return store.Singleton([]byte(acc), func() error {
+		for _, v := range accIndexes(acc) {
+			if v.Name == def.Name {
+				return fmt.Errorf("index %v already exists", def.Name)
+			}
+		}
+		b := store.db.NewBatch()
+		err := buildIndex(acc, b, &def)
+		if err != nil {
+			return err
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		idxMu.Lock()
+		indexes[acc] = append(indexes[acc], def)
+		idxMu.Unlock()
+		return nil
+	})
+}
+
+// buildIndex writes definition of the index with a new key and entries
+// for existing values
+func buildIndex(acc string, b *pebble.Batch, def *IndexDef) error {
+	c := cd.Index{Prefix: def.Prefix, Path: def.Path}
+	def.mac, c.KeyID, c.DEK = newDataKey()
+	d, err := c.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	err = b.Set(compID(cd.IndexDefPrefix, acc, def.Name), d, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: compID(cd.KVPrefix, acc, def.Prefix),
+		UpperBound: accUpperBound(cd.KVPrefix, acc),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key()[len(acc)+2:])
+		if !strings.HasPrefix(key, def.Prefix) {
+			break
+		}
+		v, err := decodeKV(iter.Value())
+		if err != nil {
+			return err
+		}
+		if nv, ok := def.extract(v.Data); ok {
+			err := b.Set(indexEntryID(acc, def.Name, nv, key), []byte(key), pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+		}
+	}
+	return nil
+}
+
+// encryptIndexes rebuilds indexes created before encryption was enabled,
+// so that their entries contain hashes instead of plain values.
+func encryptIndexes() (int, error) {
+	type plain struct{ acc, name string }
+	var todo []plain
+	idxMu.Lock()
+	for acc, defs := range indexes {
+		for _, v := range defs {
+			if v.mac == nil {
+				todo = append(todo, plain{acc, v.Name})
+			}
+		}
+	}
+	idxMu.Unlock()
+	count := 0
+	for _, v := range todo {
+		err := store.Singleton([]byte(v.acc), func() error {
+			def, ok := getIndex(v.acc, v.name)
+			if !ok || def.mac != nil { // dropped or rebuilt in the meantime
+				return nil
+			}
+			b := store.db.NewBatch()
+			p := indexPrefix(v.acc, v.name)
+			err := b.DeleteRange(p, append(p[:len(p)-1:len(p)-1], 1), pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			err = buildIndex(v.acc, b, def)
+			if err != nil {
+				return err
+			}
+			err = b.Commit(pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			idxMu.Lock()
+			for i, d := range indexes[v.acc] {
+				if d.Name == v.name {
+					indexes[v.acc][i] = *def
+				}
+			}
+			idxMu.Unlock()
+			count++
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func dropIndex(acc, name string) error {
+	return store.Singleton([]byte(acc), func() error {
+		idxMu.Lock()
+		var res []IndexDef
+		for _, v := range indexes[acc] {
+			if v.Name != name {
+				res = append(res, v)
+			}
+		}
+		indexes[acc] = res
+		idxMu.Unlock()
+
+		b := store.db.NewBatch()
+		err := b.Delete(compID(cd.IndexDefPrefix, acc, name), pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		p := indexPrefix(acc, name)
+		err = b.DeleteRange(p, append(p[:len(p)-1:len(p)-1], 1), pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	})
+}
+
+type IndexQuery struct {
+	Name   string
+	Eq     json.RawMessage // exact value
+	From   json.RawMessage // inclusive
+	To     json.RawMessage // exclusive
+	Cursor []byte          // returned by previous query to get next page
+	Limit  int
+}
+
+type IndexQueryRes struct {
+	KV     []KV   `json:"kv"`
+	Cursor []byte `json:"cursor,omitempty"` // empty if there are no more results
+}
+
+func queryIndex(acc string, q IndexQuery) (IndexQueryRes, error) {
+	var res IndexQueryRes
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 100
+	}
+	idx, ok := getIndex(acc, q.Name)
+	if !ok {
+		return res, fmt.Errorf("%w: index %v", cd.ErrNotFound, q.Name)
+	}
+	if idx.mac != nil && (q.From != nil || q.To != nil) {
+		return res, fmt.Errorf("index %v is encrypted, only Eq queries are supported", q.Name)
+	}
+	p := indexPrefix(acc, q.Name)
+	lower := p
+	upper := append(p[:len(p)-1:len(p)-1], 1)
+	enc := func(d json.RawMessage) ([]byte, error) {
+		v, ok := idx.encode(d)
+		if !ok {
+			return nil, fmt.Errorf("only scalar values can be queried: %s", d)
+		}
+		return append(p[:len(p):len(p)], v...), nil
+	}
+	if q.Eq != nil {
+		v, err := enc(q.Eq)
+		if err != nil {
+			return res, err
+		}
+		lower = append(v[:len(v):len(v)], 0)
+		upper = append(v[:len(v):len(v)], 1)
+	}
+	if q.From != nil {
+		v, err := enc(q.From)
+		if err != nil {
+			return res, err
+		}
+		lower = v
+	}
+	if q.To != nil {
+		v, err := enc(q.To)
+		if err != nil {
+			return res, err
+		}
+		upper = v
+	}
+	if q.Cursor != nil {
+		c := append(p[:len(p):len(p)], q.Cursor...)
+		if bytes.Compare(c, lower) >= 0 {
+			lower = append(c, 0)
+		}
+	}
+	// entries & values are read from the same snapshot, so that
+	// concurrent writes can't return value that doesn't match the query
+	snap := store.db.NewSnapshot()
+	defer snap.Close()
+	iter, err := snap.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	if err != nil {
+		return res, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	res.KV = []KV{}
+	var cursor []byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		if len(res.KV) == q.Limit {
+			res.Cursor = cursor
+			break
+		}
+		cursor = append(cursor[:0], iter.Key()[len(p):]...)
+		key := string(iter.Value())
+		v, err := getKV(acc, snap, key)
+		if err != nil {
+			return res, err
+		}
+		if v == nil {
+			continue
+		}
+		// skip stale entries, e.g. missing fields indexed as null before
+		ev := iter.Key()[len(p) : len(iter.Key())-len(key)-1]
+		if nv, ok := idx.extract(v.Data); !ok || !bytes.Equal(nv, ev) {
+			continue
+		}
+		res.KV = append(res.KV, newKV(key, v))
+	}
+	return res, nil
+}
+
+type IndexRequest struct {
+	Create *IndexDef
+	Drop   string
+	Query  *IndexQuery
+}
+
+func IndexHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var req IndexRequest
+	err = json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	perm := PermAdmin
+	if req.Create == nil && req.Drop == "" {
+		perm = PermRead
+	}
+	if !checkAuth(ctx, access{acc, "", perm}) {
+		return
+	}
+	err = allowRequest(acc)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var res interface{} = struct{}{}
+	switch {
+	case req.Create != nil:
+		err = createIndex(acc, *req.Create)
+	case req.Drop != "":
+		err = dropIndex(acc, req.Drop)
+	case req.Query != nil:
+		res, err = queryIndex(acc, *req.Query)
+	default:
+		err = fmt.Errorf("empty index request")
+	}
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	d, err := json.Marshal(res)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	ctx.Response.SetBody(d)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	json "github.com/goccy/go-json"
+)
+
+// Small subset of JSONPath that is enough to address a single node
+// inside of a stored document:
+//
+//	$.limits.daily
+//	$.items[0].name
+//	$['key with spaces'].value
+type jsonPath []pathElem
+
+type pathElem struct {
+	key   string
+	idx   int
+	isIdx bool
+}
+
+func parseJSONPath(p string) (jsonPath, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("path should start with $: %v", p)
+	}
+	var res jsonPath
+	i := 1
+	for i < len(p) {
+		switch p[i] {
+		case '.':
+			j := i + 1
+			for j < len(p) && p[j] != '.' && p[j] != '[' {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("empty field name at %v: %v", i, p)
+			}
+			res = append(res, pathElem{key: p[i+1 : j]})
+			i = j
+		case '[':
+			end := strings.IndexByte(p[i:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed bracket at %v: %v", i, p)
+			}
+			v := p[i+1 : i+end]
+			if len(v) >= 2 && (v[0] == '\'' || v[0] == '"') && v[len(v)-1] == v[0] {
+				res = append(res, pathElem{key: v[1 : len(v)-1]})
+			} else {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("bad array index at %v: %v", i, p)
+				}
+				res = append(res, pathElem{idx: n, isIdx: true})
+			}
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("unexpected character at %v: %v", i, p)
+		}
+	}
+	return res, nil
+}
+
+// Extract returns raw JSON of the node addressed by path.
+// Returns nil if node does not exist.
+func (p jsonPath) Extract(data []byte) json.RawMessage {
+	cur := json.RawMessage(data)
+	for _, e := range p {
+		if e.isIdx {
+			var arr []json.RawMessage
+			if json.Unmarshal(cur, &arr) != nil || e.idx >= len(arr) {
+				return nil
+			}
+			cur = arr[e.idx]
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(cur, &obj) != nil {
+			return nil
+		}
+		v, ok := obj[e.key]
+		if !ok {
+			return nil
+		}
+		cur = v
+	}
+	return cur
+}
+
+// Update replaces node addressed by path with the result of f.
+// Missing objects along the path are created. Returns updated document.
+func (p jsonPath) Update(doc interface{}, f func(old interface{}, found bool) (interface{}, error)) (interface{}, error) {
+	if len(p) == 0 {
+		return f(doc, doc != nil)
+	}
+	e := p[0]
+	if e.isIdx {
+		arr, ok := doc.([]interface{})
+		if !ok || e.idx >= len(arr) {
+			return nil, fmt.Errorf("array index out of range: %v", e.idx)
+		}
+		v, err := p[1:].Update(arr[e.idx], f)
+		if err != nil {
+			return nil, err
+		}
+		arr[e.idx] = v
+		return arr, nil
+	}
+	obj, ok := doc.(map[string]interface{})
+	if doc == nil {
+		obj, ok = map[string]interface{}{}, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("not an object at field: %v", e.key)
+	}
+	v, err := p[1:].Update(obj[e.key], f)
+	if err != nil {
+		return nil, err
+	}
+	obj[e.key] = v
+	return obj, nil
+}
+
+func decodeJSON(d []byte) (interface{}, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// applyJSONOp performs in-document operation on the node and returns new node.
+func applyJSONOp(op string, old interface{}, found bool, arg interface{}) (interface{}, error) {
+	switch op {
+	case "incr":
+		if !found {
+			old = json.Number("0")
+		}
+		return addNumbers(old, arg)
+	case "append", "add_to_set", "remove":
+		var arr []interface{}
+		if found {
+			var ok bool
+			arr, ok = old.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%v: value is not an array", op)
+			}
+		}
+		switch op {
+		case "append":
+			return append(arr, arg), nil
+		case "add_to_set":
+			for _, v := range arr {
+				if reflect.DeepEqual(v, arg) {
+					return arr, nil
+				}
+			}
+			return append(arr, arg), nil
+		default:
+			res := make([]interface{}, 0, len(arr))
+			for _, v := range arr {
+				if !reflect.DeepEqual(v, arg) {
+					res = append(res, v)
+				}
+			}
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown op: %v", op)
+}
+
+func addNumbers(a, b interface{}) (interface{}, error) {
+	an, ok1 := a.(json.Number)
+	bn, ok2 := b.(json.Number)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("incr: value is not a number")
+	}
+	ai, err1 := an.Int64()
+	bi, err2 := bn.Int64()
+	if err1 == nil && err2 == nil {
+		return json.Number(strconv.FormatInt(ai+bi, 10)), nil
+	}
+	af, err1 := an.Float64()
+	bf, err2 := bn.Float64()
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("incr: value is not a number")
+	}
+	return json.Number(strconv.FormatFloat(af+bf, 'g', -1, 64)), nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 
@@ -22,6 +24,19 @@ type Config struct {
 	ListenAddr string         `yaml:"ListenAddr"`
 	DBPath     string         `yaml:"DBPath"`
 	DBOptions  pebble.Options `yaml:"DBOptions"`
+	History    []HistoryRule  `yaml:"History"` // retention of previous KV versions
+	Topics     []TopicRule    `yaml:"Topics"`  // retention of topic messages
+	// compression of large values
+	Compression CompressionConfig `yaml:"Compression"`
+	// per-account limits
+	Quotas QuotaConfig `yaml:"Quotas"`
+	// API keys & permissions
+	Auth AuthConfig `yaml:"Auth"`
+	TLS  TLSConfig  `yaml:"TLS"`
+	// encryption of stored values
+	Encryption EncryptionConfig `yaml:"Encryption"`
+	// retention of idempotency records
+	Idempotency IdempotencyConfig `yaml:"Idempotency"`
 	// TODO: backups & restore from S3
 	//
 	// S3 speed:  ~1GB/s per avg instance   6GB/sec network-optimized
@@ -49,9 +64,9 @@ func main() {
 }
 
 var store *Store
+var cfg Config
 
 func Start(ctx context.Context) error {
-	var cfg Config
 	yd, err := os.ReadFile("config.yml")
 	if err != nil {
 		return err
@@ -60,17 +75,55 @@ func Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	switch cfg.Compression.Algo {
+	case "", "snappy", "zstd":
+	default:
+		return fmt.Errorf("unknown compression algo: %v", cfg.Compression.Algo)
+	}
+	err = InitEncryption()
+	if err != nil {
+		return err
+	}
 	db, err := pebble.Open(cfg.DBPath, &cfg.DBOptions)
 	if err != nil {
 		return err
 	}
 	store = NewStore(db)
 	InitFastLocks()
+	InitQueues()
+	InitIndexes()
+	InitAuth()
+	go RotationLoop(ctx)
+	go IdempotencySweepLoop(ctx)
+	go TopicSweepLoop(ctx)
+	go HistorySweepLoop(ctx)
+	go SchedulerLoop(ctx)
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	ln, err = tlsListener(ln, cfg.TLS)
+	if err != nil {
+		return err
+	}
 	go func() {
 		log.Print("START ", cfg.ListenAddr)
 		router := fasthttprouter.New()
 		router.POST("/req/:acc", RequestHandler)
 		router.POST("/watch/:acc", WatchHandler)
+		router.POST("/history/:acc", HistoryHandler)
+		router.POST("/read", ReadHandler)
+		router.POST("/index/:acc", IndexHandler)
+		router.POST("/queue/:acc", QueueHandler)
+		router.POST("/topic/:acc", TopicHandler)
+		router.GET("/kv/:acc/*key", RawGetHandler)
+		router.PUT("/kv/:acc/*key", RawPutHandler)
+		router.DELETE("/kv/:acc/*key", RawDeleteHandler)
+		router.POST("/admin/accounts", AccountsHandler)
+		router.POST("/admin/stats/:acc", AccountStatsHandler)
+		router.POST("/admin/delete/:acc", AccountDeleteHandler)
+		router.POST("/admin/copy/:acc", AccountCopyHandler)
+		router.POST("/admin/dlq/:acc", DeadLetterHandler)
 
 		router.NotFound = func(ctx *fasthttp.RequestCtx) {
 			ctx.SetStatusCode(404)
@@ -87,7 +140,7 @@ func Start(ctx context.Context) error {
 			NoDefaultDate:                 true,
 			NoDefaultServerHeader:         true,
 		}
-		err := s.ListenAndServe(cfg.ListenAddr)
+		err := s.Serve(ln)
 		if err != nil {
 			panic(err)
 		}
@@ -4,6 +4,7 @@ import (
 	"clouddragon/cd"
 	"fmt"
 	"hash/fnv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,9 +14,14 @@ import (
 
 var fmu = []*fastLockMutex{}
 
+// leases of dequeued messages are kept apart from client locks, so that
+// lock with the same key can't block them
+var lmu = []*fastLockMutex{}
+
 func InitFastLocks() {
 	for i := 0; i < mCount; i++ {
 		fmu = append(fmu, newFastLockMutex())
+		lmu = append(lmu, newFastLockMutex())
 	}
 	iter, err := store.db.NewIter(&pebble.IterOptions{
 		LowerBound: []byte{cd.LocksPrefix},
@@ -61,11 +67,20 @@ func chooseLock(id string) *fastLockMutex {
 	return fmu[kid%mCount]
 }
 
+func chooseLease(id string) *fastLockMutex {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return lmu[h.Sum64()%mCount]
+}
+
 func memLock(acc, id string, dur, wait int) (int64, error) {
 	cid := acc + string([]byte{0}) + id
 	handle, ok := chooseLock(cid).Lock(cid, dur, wait, 0)
+	if !ok && wait > 0 {
+		return 0, fmt.Errorf("%w: %v", cd.ErrLockTimeout, id)
+	}
 	if !ok {
-		return 0, cd.ErrNotLocked
+		return 0, fmt.Errorf("%w: %v", cd.ErrNotLocked, id)
 	}
 	return handle, nil
 }
@@ -87,6 +102,66 @@ func memExtendLock(acc, id string, handle int64, dur int) error {
 	return chooseLock(cid).extendLock(cid, handle, time.Now().Unix()+int64(dur))
 }
 
+// memLease is a lock that calls expire if it's not released or extended
+// in time. Used for leases of dequeued messages.
+func memLease(acc, id string, dur int, handle int64, expire func()) error {
+	cid := acc + string([]byte{0}) + id
+	_, ok := chooseLease(cid).lock(cid, dur, 0, handle, expire)
+	if !ok {
+		return fmt.Errorf("%w: lease %q is already registered", cd.ErrInternal, id)
+	}
+	return nil
+}
+
+func memUnlockLease(acc, id string, handle int64) error {
+	cid := acc + string([]byte{0}) + id
+	ch, err := chooseLease(cid).Unlock(cid, handle)
+	if err != nil {
+		return err
+	}
+	if ch != nil {
+		close(ch)
+	}
+	return nil
+}
+
+func memExtendLease(acc, id string, handle int64, dur int) error {
+	cid := acc + string([]byte{0}) + id
+	return chooseLease(cid).extendLock(cid, handle, time.Now().Unix()+int64(dur))
+}
+
+func newHandle() int64 {
+	return atomic.AddInt64(&handleCounter, 1)
+}
+
+// bumpHandle makes sure that new handles are greater than h
+func bumpHandle(h int64) {
+	for {
+		c := atomic.LoadInt64(&handleCounter)
+		if c > h || atomic.CompareAndSwapInt64(&handleCounter, c, h+1) {
+			return
+		}
+	}
+}
+
+// memUnlockAccount releases all locks & leases of the account
+func memUnlockAccount(acc string) {
+	prefix := acc + string([]byte{0})
+	for _, km := range append(fmu[:len(fmu):len(fmu)], lmu...) {
+		km.l.Lock()
+		for key := range km.m {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			ch, _ := km.unlock(key, 0)
+			if ch != nil {
+				close(ch)
+			}
+		}
+		km.l.Unlock()
+	}
+}
+
 type FLock struct {
 	ch     chan bool
 	handle int64
@@ -130,10 +205,10 @@ func (km *fastLockMutex) extendLock(key string, handle int64, till int64) error
 	defer km.l.Unlock()
 	fl, ok := km.m[key]
 	if !ok {
-		return fmt.Errorf("lock not found")
+		return fmt.Errorf("%w: lock not found", cd.ErrNotLocked)
 	}
 	if handle != 0 && fl.handle != handle {
-		return fmt.Errorf("handle mismatch")
+		return cd.ErrHandleMismatch
 	}
 	fl.till = till
 	km.m[key] = fl
@@ -152,7 +227,7 @@ func (km *fastLockMutex) unlock(key string, handle int64) (chan bool, error) {
 		return nil, nil
 	}
 	if handle != 0 && fl.handle != handle {
-		return nil, fmt.Errorf("handle mismatch")
+		return nil, cd.ErrHandleMismatch
 	}
 	delete(km.m, key)
 	km.c.Signal()
@@ -164,7 +239,7 @@ func (km *fastLockMutex) UnlockTimeout(key string, till int64, ch chan bool) (ch
 	defer km.l.Unlock()
 	fl := km.m[key]
 	if fl.ch != ch {
-		return nil, 0
+		return nil, till
 	}
 	if fl.till != till { // reschedule timer
 		return nil, fl.till
@@ -172,12 +247,16 @@ func (km *fastLockMutex) UnlockTimeout(key string, till int64, ch chan bool) (ch
 	// unlock only if value is the same
 	delete(km.m, key)
 	km.c.Signal()
-	return fl.ch, 0
+	return fl.ch, till
 }
 
 var handleCounter = int64(1)
 
 func (km *fastLockMutex) Lock(key string, dur, wait int, oldHandle int64) (int64, bool) {
+	return km.lock(key, dur, wait, oldHandle, nil)
+}
+
+func (km *fastLockMutex) lock(key string, dur, wait int, oldHandle int64, expire func()) (int64, bool) {
 	start := time.Now().Unix()
 	handle := atomic.AddInt64(&handleCounter, 1)
 	if oldHandle != 0 {
@@ -214,6 +293,9 @@ func (km *fastLockMutex) Lock(key string, dur, wait int, oldHandle int64) (int64
 				}
 				if retCh != nil {
 					close(retCh)
+					if expire != nil {
+						expire()
+					}
 				}
 				return
 			case <-ch:
@@ -47,10 +47,20 @@ func (km *notifier) Attach(key string, ver int64) {
 		return
 	}
 	v.Listeners++
+	if v.Version < ver { // versions only grow - older notification is stale
+		v.Version = ver
+	}
 }
 
 func (km *notifier) Listen(key string, ver int64, dur int) int64 {
 	start := time.Now().Unix()
+	// wake up on timeout even if there are no notifications for other keys
+	t := time.AfterFunc(time.Second*time.Duration(dur+1), func() {
+		km.l.Lock()
+		km.c.Broadcast()
+		km.l.Unlock()
+	})
+	defer t.Stop()
 	km.l.Lock()
 	defer km.l.Unlock()
 
@@ -0,0 +1,877 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Durable FIFO queues. Messages are enqueued with other operations of
+// Request in the same batch. Dequeued messages are moved to leases table
+// and returned back to the queue if they are not acked till lease expires.
+//
+// TableID|Account|0|Queue|0|ID(big endian)  ->  cd.QueueMsg
+// TableID|Account|0|Queue                   ->  cd.QueueMeta
+//
+// ID of the message is taken from QueueMeta.Counter, so messages are
+// iterated in the order they were enqueued.
+func queueMsgID(t int, acc, queue string, id int64) []byte {
+	b := compID(t, acc, queue)
+	b = append(b, 0)
+	return binary.BigEndian.AppendUint64(b, uint64(id))
+}
+
+// Queues with priorities keep the priority between queue and ID, so that
+// messages of higher priority come first and are FIFO within a level.
+//
+// TableID|Account|0|Queue|0|255-Priority|ID(big endian)  ->  cd.QueueMsg
+//
+// Leased & delayed messages don't need the order, their keys are the same.
+func readyMsgID(acc, queue string, meta *cd.QueueMeta, prio uint8, id int64) []byte {
+	if meta.Priorities == 0 {
+		return queueMsgID(cd.QueuePrefix, acc, queue, id)
+	}
+	b := compID(cd.QueuePrefix, acc, queue)
+	b = append(b, 0, 255-prio)
+	return binary.BigEndian.AppendUint64(b, uint64(id))
+}
+
+func queueBounds(t int, acc, queue string) *pebble.IterOptions {
+	b := compID(t, acc, queue)
+	return &pebble.IterOptions{
+		LowerBound: append(b, 0),
+		UpperBound: append(b[:len(b):len(b)], 1),
+	}
+}
+
+// parseQueueMsgID returns account, queue & ID of the message key
+func parseQueueMsgID(key []byte) (string, string, int64) {
+	k := key[1 : len(key)-9]
+	acc, queue, _ := bytes.Cut(k, []byte{0})
+	return string(acc), string(queue), queueMsgSeq(key)
+}
+
+func queueMsgSeq(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
+
+// key used to notify consumers waiting for messages. Starts with 0, so it
+// won't clash with KV keys watched by the same notifier.
+func queueWatchKey(queue string) string {
+	return "\x00queue\x00" + queue
+}
+
+// Message groups are delivered in order, one message at a time. Only the
+// head message of a group is kept in the queue (or leased or delayed),
+// other messages of the group wait in backlog till the head is acked, so
+// dequeue never has to skip messages of busy groups.
+//
+// TableID|Account|0|Queue|0|Group               ->  ID of the head message
+// TableID|Account|0|Queue|0|Group|0|ID(big endian)  ->  cd.QueueMsg
+func queueGroupID(acc, queue, group string) []byte {
+	b := compID(cd.QueueGroupPrefix, acc, queue)
+	b = append(b, 0)
+	return append(b, group...)
+}
+
+func backlogMsgID(acc, queue, group string, id int64) []byte {
+	b := compID(cd.QueueBacklogPrefix, acc, queue)
+	b = append(b, 0)
+	b = append(b, group...)
+	b = append(b, 0)
+	return binary.BigEndian.AppendUint64(b, uint64(id))
+}
+
+// readyMsg puts encoded message d to the queue or to the backlog of its
+// group, if the group already has another head.
+func readyMsg(acc string, b *pebble.Batch, queue string, id int64, m *cd.QueueMsg, d []byte, meta *cd.QueueMeta) error {
+	if m.Group != "" {
+		head, err := GetInt64(queueGroupID(acc, queue, m.Group), b)
+		if err != nil {
+			return err
+		}
+		if head == nil {
+			err = SetInt64(queueGroupID(acc, queue, m.Group), id, b)
+			if err != nil {
+				return err
+			}
+		} else if *head != id {
+			err = b.Set(backlogMsgID(acc, queue, m.Group, id), d, pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			return nil
+		}
+	}
+	err := b.Set(readyMsgID(acc, queue, meta, m.Priority, id), d, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return nil
+}
+
+// releaseGroup moves the next message of the group to the queue, if
+// message id is the head of the group
+func releaseGroup(acc string, b *pebble.Batch, queue string, id int64, m *cd.QueueMsg, meta *cd.QueueMeta) error {
+	if m.Group == "" {
+		return nil
+	}
+	key := queueGroupID(acc, queue, m.Group)
+	head, err := GetInt64(key, b)
+	if err != nil || head == nil || *head != id {
+		return err
+	}
+	p := backlogMsgID(acc, queue, m.Group, 0)
+	p = p[: len(p)-8 : len(p)-8]
+	iter, err := b.NewIter(&pebble.IterOptions{
+		LowerBound: p,
+		UpperBound: append(p[:len(p)-1:len(p)-1], 1),
+	})
+	if err != nil {
+		return err
+	}
+	if !iter.First() {
+		err = iter.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = b.Delete(key, pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	}
+	next := append([]byte{}, iter.Key()...)
+	d := append([]byte{}, iter.Value()...)
+	err = iter.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	var n cd.QueueMsg
+	_, err = n.UnmarshalMsg(d)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	nid := queueMsgSeq(next)
+	err = b.Delete(next, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	err = SetInt64(key, nid, b)
+	if err != nil {
+		return err
+	}
+	meta.Version++
+	err = b.Set(readyMsgID(acc, queue, meta, n.Priority, nid), d, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return nil
+}
+
+func validQueue(queue string) error {
+	if len(queue) == 0 || len(queue) > 255 {
+		return fmt.Errorf("queue name len is not in range 1~255")
+	}
+	if strings.IndexByte(queue, 0) != -1 {
+		return fmt.Errorf("0 is not allowed as a character in queue name")
+	}
+	return nil
+}
+
+func getQueueMeta(acc string, r pebble.Reader, queue string) (cd.QueueMeta, error) {
+	var m cd.QueueMeta
+	d, closer, err := r.Get(compID(cd.QueueMetaPrefix, acc, queue))
+	if err == pebble.ErrNotFound {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer closer.Close()
+	_, err = m.UnmarshalMsg(d)
+	return m, err
+}
+
+func setQueueMeta(acc string, b *pebble.Batch, queue string, m cd.QueueMeta) error {
+	d, err := m.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	err = b.Set(compID(cd.QueueMetaPrefix, acc, queue), d, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return nil
+}
+
+func encodeQueueMsg(m *cd.QueueMsg, data []byte) ([]byte, error) {
+	d, c := compress(data)
+	m.Comp = c
+	m.KeyID, m.DEK, m.Data = encrypt(d)
+	return m.MarshalMsg(nil)
+}
+
+// queueMsgData returns decrypted & decompressed data of the message
+func queueMsgData(m *cd.QueueMsg) ([]byte, error) {
+	d, err := decrypt(m.KeyID, m.DEK, m.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	d, err = decompress(d, m.Comp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return d, nil
+}
+
+type EnqueueRes struct {
+	Queue string  `json:"q"`
+	IDs   []int64 `json:"ids"`
+	ver   int64   // QueueMeta.Version to notify consumers
+}
+
+func handleEnqueue(acc string, b *pebble.Batch, op EnqueueOp, res *Response) error {
+	err := validQueue(op.Queue)
+	if err != nil {
+		return err
+	}
+	meta, err := getQueueMeta(acc, b, op.Queue)
+	if err != nil {
+		return err
+	}
+	if op.Counter != 0 && op.Counter != meta.Counter {
+		return fmt.Errorf("%w: queue %v counter is %v", cd.ErrPreconditionFailed, op.Queue, meta.Counter)
+	}
+	if op.Group != "" {
+		err = validQueue(op.Group)
+		if err != nil {
+			return fmt.Errorf("bad group: %w", err)
+		}
+		// delayed message would be overtaken by later messages of the group
+		if op.Delay > 0 || op.DeliverAt > 0 {
+			return fmt.Errorf("grouped messages can't be delayed")
+		}
+	}
+	levels := max(meta.Priorities, 1)
+	if op.Priority < 0 || op.Priority >= levels {
+		return fmt.Errorf("priority %v is not in range 0~%v of queue %v", op.Priority, levels-1, op.Queue)
+	}
+	q := accQuota(acc)
+	now := time.Now().Unix()
+	at := op.DeliverAt
+	if op.Delay > 0 {
+		at = now + int64(op.Delay)
+	}
+	r := EnqueueRes{Queue: op.Queue}
+	for _, m := range op.Messages {
+		if q.MaxValueSize != 0 && len(m) > q.MaxValueSize {
+			return quotaErr("message size %v > %v", len(m), q.MaxValueSize)
+		}
+		meta.Counter++
+		r.IDs = append(r.IDs, meta.Counter)
+		rec := cd.QueueMsg{Enqueued: now, Priority: uint8(op.Priority), Group: op.Group}
+		d, err := encodeQueueMsg(&rec, m)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = addMsgUsage(acc, b, &rec, 1)
+		if err != nil {
+			return err
+		}
+		if at > now {
+			rec.Deliver = at
+			err = delayMsg(acc, b, op.Queue, meta.Counter, &rec, &meta)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		meta.Total++
+		err = readyMsg(acc, b, op.Queue, meta.Counter, &rec, d, &meta)
+		if err != nil {
+			return err
+		}
+	}
+	meta.Version++
+	r.ver = meta.Version
+	res.Enqueue = append(res.Enqueue, r)
+	return setQueueMeta(acc, b, op.Queue, meta)
+}
+
+// notifyQueues wakes up consumers waiting for enqueued messages
+func notifyQueues(acc string, res []EnqueueRes) {
+	for _, v := range res {
+		if len(v.IDs) > 0 {
+			store.notifier(acc).NotifyVersion(queueWatchKey(v.Queue), v.ver)
+		}
+	}
+}
+
+type QueueMsg struct {
+	ID       int64
+	Data     json.RawMessage
+	Enqueued int64  // unix time
+	Attempts int    // number of deliveries, including this one
+	Receipt  string // to ack, nack or extend the lease
+	Priority int    `json:",omitempty"`
+	Group    string `json:",omitempty"`
+}
+
+type QueueRes struct {
+	Messages []QueueMsg   `json:"msgs"`
+	Len      int64        `json:"len"`      // messages left in the queue
+	Inflight int64        `json:"inflight"` // dequeued, but not acked messages
+	Delayed  int64        `json:"delayed"`  // messages waiting for delivery time
+	Counter  int64        `json:"counter"`  // ID of the last enqueued message
+	Policy   *QueuePolicy `json:"policy,omitempty"`
+	Replay   bool         `json:"replay,omitempty"` // stored response of already handled request
+}
+
+func newQueueRes(meta cd.QueueMeta) QueueRes {
+	res := QueueRes{
+		Messages: []QueueMsg{},
+		Len:      meta.Total,
+		Inflight: meta.Inflight,
+		Delayed:  meta.Delayed,
+		Counter:  meta.Counter,
+	}
+	if meta.MaxDeliveries > 0 || meta.Priorities > 0 {
+		res.Policy = &QueuePolicy{meta.MaxDeliveries, meta.DeadLetter, meta.Priorities}
+	}
+	return res
+}
+
+// Receipt is ID of the message and handle of the lease. Lease handles are
+// taken from the same counter as lock handles.
+func receipt(id, handle int64) string {
+	return strconv.FormatInt(id, 10) + "." + strconv.FormatInt(handle, 10)
+}
+
+func parseReceipt(r string) (int64, int64, error) {
+	a, b, ok := strings.Cut(r, ".")
+	id, err := strconv.ParseInt(a, 10, 64)
+	if err != nil || !ok {
+		return 0, 0, fmt.Errorf("bad receipt: %v", r)
+	}
+	handle, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad receipt: %v", r)
+	}
+	return id, handle, nil
+}
+
+// key of the lease in memlock
+func leaseID(queue string, id int64) string {
+	return queue + "\x00" + strconv.FormatInt(id, 10)
+}
+
+// startLease returns message back to the queue after dur seconds,
+// unless it's acked or lease is extended.
+func startLease(acc, queue string, id int64, dur int, handle int64) error {
+	return memLease(acc, leaseID(queue, id), dur, handle, func() {
+		expireLease(acc, queue, id, handle)
+	})
+}
+
+func expireLease(acc, queue string, id, handle int64) {
+	notify := map[string]int64{} // queue -> version
+	err := store.Singleton([]byte(acc), func() error {
+		b := store.db.NewIndexedBatch()
+		meta, err := getQueueMeta(acc, b, queue)
+		if err != nil {
+			return err
+		}
+		m, err := leasedMsg(acc, b, queue, id, handle)
+		if errors.Is(err, cd.ErrNotFound) || errors.Is(err, cd.ErrHandleMismatch) {
+			return nil // acked in the meantime
+		}
+		if err != nil {
+			return err
+		}
+		ver := meta.Version
+		q, qver, err := failMsg(acc, b, queue, id, m, &meta, "lease expired", 0)
+		if err != nil {
+			return err
+		}
+		if q != "" {
+			notify[q] = qver
+		}
+		if meta.Version != ver { // requeued or group released
+			notify[queue] = meta.Version
+		}
+		err = setQueueMeta(acc, b, queue, meta)
+		if err != nil {
+			return err
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to return message %v of queue %v back: %v", id, queue, err)
+		return
+	}
+	for q, ver := range notify {
+		store.notifier(acc).NotifyVersion(queueWatchKey(q), ver)
+	}
+}
+
+// leasedMsg returns dequeued message if lease handle matches
+func leasedMsg(acc string, r pebble.Reader, queue string, id, handle int64) (*cd.QueueMsg, error) {
+	d, closer, err := r.Get(queueMsgID(cd.QueueLeasePrefix, acc, queue, id))
+	if err == pebble.ErrNotFound {
+		return nil, fmt.Errorf("%w: message %v is not in flight", cd.ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer closer.Close()
+	var m cd.QueueMsg
+	_, err = m.UnmarshalMsg(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	if m.Receipt != handle {
+		return nil, fmt.Errorf("%w: lease of message %v expired", cd.ErrHandleMismatch, id)
+	}
+	return &m, nil
+}
+
+// failMsg returns leased message back to its place in the queue, delays it
+// or moves it to dead-letter queue if it's out of delivery attempts.
+// Returns queue & version to notify consumers of. Empty queue - no need.
+func failMsg(acc string, b *pebble.Batch, queue string, id int64, m *cd.QueueMsg, meta *cd.QueueMeta, reason string, delay int) (string, int64, error) {
+	err := b.Delete(queueMsgID(cd.QueueLeasePrefix, acc, queue, id), pebble.NoSync)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	meta.Inflight--
+	m.Receipt, m.Till = 0, 0
+	m.Reason = reason
+	if delay > 0 && (meta.MaxDeliveries == 0 || m.Attempts < meta.MaxDeliveries) {
+		// group stays busy till the message is delivered again
+		m.Deliver = time.Now().Unix() + int64(delay)
+		return "", 0, delayMsg(acc, b, queue, id, m, meta)
+	}
+	if meta.MaxDeliveries > 0 && m.Attempts >= meta.MaxDeliveries {
+		err = releaseGroup(acc, b, queue, id, m, meta)
+		if err != nil {
+			return "", 0, err
+		}
+		ver, err := deadLetter(acc, b, queue, id, m, meta.DeadLetter)
+		return meta.DeadLetter, ver, err
+	}
+	// requeued message stays the head of its group
+	d, err := m.MarshalMsg(nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	meta.Total++
+	meta.Version++
+	return queue, meta.Version, readyMsg(acc, b, queue, id, m, d, meta)
+}
+
+// popMessages moves up to max messages from the head of the queue to leases
+func popMessages(acc, queue string, max, lease int, k *idemKey) (QueueRes, cd.QueueMeta, error) {
+	meta, err := getQueueMeta(acc, store.db, queue)
+	if err != nil {
+		return QueueRes{}, meta, err
+	}
+	var rep QueueRes
+	ok, err := k.get(acc, store.db, &rep)
+	if ok || err != nil {
+		rep.Replay = true
+		return rep, meta, err
+	}
+	res := newQueueRes(meta)
+	if meta.Total == 0 {
+		return res, meta, nil
+	}
+	iter, err := store.db.NewIter(queueBounds(cd.QueuePrefix, acc, queue))
+	if err != nil {
+		return res, meta, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	b := store.db.NewBatch()
+	till := time.Now().Unix() + int64(lease)
+	var handles []int64
+	for iter.First(); iter.Valid() && len(res.Messages) < max; iter.Next() {
+		var m cd.QueueMsg
+		_, err := m.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return res, meta, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		id := queueMsgSeq(iter.Key())
+		data, err := queueMsgData(&m)
+		if err != nil {
+			return res, meta, err
+		}
+		m.Attempts++
+		m.Receipt = newHandle()
+		handles = append(handles, m.Receipt)
+		m.Till = till
+		d, err := m.MarshalMsg(nil)
+		if err != nil {
+			return res, meta, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = b.Set(queueMsgID(cd.QueueLeasePrefix, acc, queue, id), d, pebble.NoSync)
+		if err != nil {
+			return res, meta, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = b.Delete(iter.Key(), pebble.NoSync)
+		if err != nil {
+			return res, meta, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		res.Messages = append(res.Messages, QueueMsg{
+			ID:       id,
+			Data:     data,
+			Enqueued: m.Enqueued,
+			Attempts: m.Attempts,
+			Receipt:  receipt(id, m.Receipt),
+			Priority: int(m.Priority),
+			Group:    m.Group,
+		})
+	}
+	meta.Total -= int64(len(res.Messages))
+	meta.Inflight += int64(len(res.Messages))
+	res.Len, res.Inflight = meta.Total, meta.Inflight
+	err = setQueueMeta(acc, b, queue, meta)
+	if err != nil {
+		return res, meta, err
+	}
+	err = k.save(acc, b, res)
+	if err != nil {
+		return res, meta, err
+	}
+	// messages without lease timer would never return to the queue
+	release := func(n int) {
+		for i, m := range res.Messages[:n] {
+			memUnlockLease(acc, leaseID(queue, m.ID), handles[i])
+		}
+	}
+	for i, m := range res.Messages {
+		err = startLease(acc, queue, m.ID, lease, handles[i])
+		if err != nil {
+			release(i)
+			return res, meta, err
+		}
+	}
+	err = b.Commit(pebble.NoSync)
+	if err != nil {
+		release(len(res.Messages))
+		return res, meta, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return res, meta, nil
+}
+
+// dequeue returns up to max messages. If queue is empty - waits for new
+// messages up to wait seconds.
+func dequeue(acc, queue string, max, wait, lease int, k *idemKey) (QueueRes, error) {
+	if max <= 0 {
+		max = 1
+	}
+	max = min(max, 1000)
+	if wait > 0 {
+		if !watchSlots.acquire(acc, accQuota(acc).MaxWatchers) {
+			return QueueRes{}, quotaErr("max %v watchers", accQuota(acc).MaxWatchers)
+		}
+		defer watchSlots.release(acc)
+	}
+	n := store.notifier(acc)
+	key := queueWatchKey(queue)
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for {
+		var res QueueRes
+		var meta cd.QueueMeta
+		left := int(math.Ceil(time.Until(deadline).Seconds())) // round up, so that Wait:1 actually waits
+		err := store.Singleton([]byte(acc), func() error {
+			var err error
+			res, meta, err = popMessages(acc, queue, max, lease, k)
+			if err == nil && len(res.Messages) == 0 && left > 0 {
+				n.Attach(key, meta.Version)
+			}
+			return err
+		})
+		if err != nil || len(res.Messages) > 0 || left <= 0 {
+			return res, err
+		}
+		n.Listen(key, meta.Version, left)
+	}
+}
+
+// settleMessages acks, nacks and extends leases of dequeued messages and
+// cancels delayed ones. Returns response recorded for idempotency key k,
+// nil - without the key.
+func settleMessages(acc string, req QueueRequest, k *idemKey) (*QueueRes, error) {
+	var after []func()           // update in-memory leases only after commit
+	notify := map[string]int64{} // queue -> version
+	var replay *QueueRes
+	err := store.Singleton([]byte(acc), func() error {
+		b := store.db.NewIndexedBatch()
+		var rep QueueRes
+		ok, err := k.get(acc, b, &rep)
+		if err != nil {
+			return err
+		}
+		if ok {
+			rep.Replay = true
+			replay = &rep
+			return nil
+		}
+		meta, err := getQueueMeta(acc, b, req.Queue)
+		if err != nil {
+			return err
+		}
+		ver := meta.Version
+		for _, r := range req.Ack {
+			id, handle, err := parseReceipt(r)
+			if err != nil {
+				return err
+			}
+			m, err := leasedMsg(acc, b, req.Queue, id, handle)
+			if err != nil {
+				return err
+			}
+			err = b.Delete(queueMsgID(cd.QueueLeasePrefix, acc, req.Queue, id), pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			meta.Inflight--
+			err = releaseGroup(acc, b, req.Queue, id, m, &meta)
+			if err != nil {
+				return err
+			}
+			err = addMsgUsage(acc, b, m, -1)
+			if err != nil {
+				return err
+			}
+			after = append(after, func() {
+				memUnlockLease(acc, leaseID(req.Queue, id), handle)
+			})
+		}
+		for _, r := range req.Nack {
+			id, handle, err := parseReceipt(r)
+			if err != nil {
+				return err
+			}
+			m, err := leasedMsg(acc, b, req.Queue, id, handle)
+			if err != nil {
+				return err
+			}
+			reason := req.Reason
+			if reason == "" {
+				reason = "nacked"
+			}
+			q, ver, err := failMsg(acc, b, req.Queue, id, m, &meta, reason, req.Delay)
+			if err != nil {
+				return err
+			}
+			if q != "" {
+				notify[q] = ver
+			}
+			after = append(after, func() {
+				memUnlockLease(acc, leaseID(req.Queue, id), handle)
+			})
+		}
+		for _, r := range req.Extend {
+			id, handle, err := parseReceipt(r)
+			if err != nil {
+				return err
+			}
+			m, err := leasedMsg(acc, b, req.Queue, id, handle)
+			if err != nil {
+				return err
+			}
+			m.Till = time.Now().Unix() + int64(req.Lease)
+			d, err := m.MarshalMsg(nil)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			err = b.Set(queueMsgID(cd.QueueLeasePrefix, acc, req.Queue, id), d, pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			after = append(after, func() {
+				memExtendLease(acc, leaseID(req.Queue, id), handle, req.Lease)
+			})
+		}
+		for _, id := range req.Cancel {
+			err := cancelDelayed(acc, b, req.Queue, id, &meta)
+			if err != nil {
+				return err
+			}
+		}
+		if meta.Version != ver { // requeued or group released
+			notify[req.Queue] = meta.Version
+		}
+		err = setQueueMeta(acc, b, req.Queue, meta)
+		if err != nil {
+			return err
+		}
+		if k != nil {
+			res := newQueueRes(meta)
+			err = k.save(acc, b, res)
+			if err != nil {
+				return err
+			}
+			replay = &res
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		for _, f := range after {
+			f()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for q, ver := range notify {
+		store.notifier(acc).NotifyVersion(queueWatchKey(q), ver)
+	}
+	return replay, nil
+}
+
+// restoreLeases starts lease timers for dequeued messages after restart.
+// Expired leases are returned back to the queue right away.
+func restoreLeases(opts *pebble.IterOptions) error {
+	iter, err := store.db.NewIter(opts)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		acc, queue, id := parseQueueMsgID(iter.Key())
+		var m cd.QueueMsg
+		_, err := m.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		// make sure new lock & lease handles never match restored ones
+		bumpHandle(m.Receipt)
+		dur := m.Till - time.Now().Unix()
+		if dur < 0 {
+			dur = 0
+		}
+		err = startLease(acc, queue, id, int(dur), m.Receipt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func InitQueues() {
+	err := restoreLeases(&pebble.IterOptions{
+		LowerBound: []byte{cd.QueueLeasePrefix},
+		UpperBound: []byte{cd.QueueLeasePrefix + 1},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type QueueRequest struct {
+	Queue   string
+	Ack     []string // receipts of processed messages
+	Nack    []string // receipts of messages to return to the queue
+	Delay   int      // seconds to wait before nacked messages are redelivered
+	Reason  string   // why nacked messages failed. Kept for dead-lettered ones
+	Extend  []string // receipts of messages to extend lease for
+	Cancel  []int64  // IDs of delayed messages to remove
+	Policy  *QueuePolicy
+	Dequeue int // number of messages to receive. 0 - only return queue length
+	Wait    int // seconds to wait for messages if queue is empty
+	Lease   int // seconds dequeued or extended messages are invisible. Default 30
+}
+
+func QueueHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var req QueueRequest
+	err = json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	err = validQueue(req.Queue)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if req.Lease <= 0 {
+		req.Lease = 30
+	}
+	settle := len(req.Ack)+len(req.Nack)+len(req.Extend)+len(req.Cancel) > 0
+	perm := PermWrite
+	if req.Dequeue == 0 && !settle {
+		perm = PermRead
+	}
+	if req.Policy != nil {
+		perm = PermAdmin
+	}
+	if !checkAuth(ctx, access{acc, req.Queue, perm}) {
+		return
+	}
+	err = allowRequest(acc)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	// steps of the request are committed separately, so only one of them
+	// can be recorded for replay
+	k := headerIdempotency(ctx, access{acc, req.Queue, perm})
+	if k != nil && (req.Policy != nil || settle && req.Dequeue > 0) {
+		writeError(ctx, fmt.Errorf("with Idempotency-Key request can either settle or dequeue messages"))
+		return
+	}
+	if req.Policy != nil {
+		err = setQueuePolicy(acc, req.Queue, *req.Policy)
+		if err != nil {
+			writeError(ctx, err)
+			return
+		}
+	}
+	var settled *QueueRes // response recorded for Idempotency-Key
+	if settle {
+		settled, err = settleMessages(acc, req, k)
+		if err != nil {
+			writeError(ctx, err)
+			return
+		}
+	}
+	var res QueueRes
+	switch {
+	case settled != nil:
+		res = *settled
+	case req.Dequeue == 0:
+		var meta cd.QueueMeta
+		meta, err = getQueueMeta(acc, store.db, req.Queue)
+		res = newQueueRes(meta)
+	default:
+		res, err = dequeue(acc, req.Queue, req.Dequeue, req.Wait, req.Lease, k)
+	}
+	if res.Replay {
+		ctx.Response.Header.Set("Idempotent-Replayed", "true")
+	}
+	writeJSON(ctx, res, err)
+}
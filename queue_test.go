@@ -0,0 +1,252 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	json "github.com/goccy/go-json"
+)
+
+func TestMain(m *testing.M) {
+	db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		panic(err)
+	}
+	store = NewStore(db)
+	InitFastLocks()
+	go store.FlushLoop(context.Background())
+	os.Exit(m.Run())
+}
+
+func testEnqueue(acc string, op EnqueueOp) ([]int64, error) {
+	var res Response
+	err := store.Singleton([]byte(acc), func() error {
+		b := store.db.NewIndexedBatch()
+		err := handleEnqueue(acc, b, op, &res)
+		if err != nil {
+			return err
+		}
+		return b.Commit(pebble.NoSync)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Enqueue[0].IDs, nil
+}
+
+func mustEnqueue(t *testing.T, acc string, op EnqueueOp) []int64 {
+	t.Helper()
+	ids, err := testEnqueue(acc, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func msgs(data ...string) []json.RawMessage {
+	var res []json.RawMessage
+	for _, d := range data {
+		res = append(res, json.RawMessage(`"`+d+`"`))
+	}
+	return res
+}
+
+func mustDequeue(t *testing.T, acc, queue string, max, lease int) []QueueMsg {
+	t.Helper()
+	res, err := dequeue(acc, queue, max, 0, lease, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Messages
+}
+
+func mustSettle(t *testing.T, acc string, req QueueRequest) {
+	t.Helper()
+	_, err := settleMessages(acc, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func msgIDs(ms []QueueMsg) []int64 {
+	res := []int64{}
+	for _, m := range ms {
+		res = append(res, m.ID)
+	}
+	return res
+}
+
+func expectIDs(t *testing.T, ms []QueueMsg, ids ...int64) {
+	t.Helper()
+	got := msgIDs(ms)
+	if len(got) != len(ids) {
+		t.Fatalf("expected messages %v, got %v", ids, got)
+	}
+	for i := range ids {
+		if got[i] != ids[i] {
+			t.Fatalf("expected messages %v, got %v", ids, got)
+		}
+	}
+}
+
+func expectMeta(t *testing.T, acc, queue string, total, inflight, delayed int64) {
+	t.Helper()
+	meta, err := getQueueMeta(acc, store.db, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Total != total || meta.Inflight != inflight || meta.Delayed != delayed {
+		t.Fatalf("expected total %v, inflight %v, delayed %v, got %v, %v, %v",
+			total, inflight, delayed, meta.Total, meta.Inflight, meta.Delayed)
+	}
+}
+
+func TestQueueAck(t *testing.T) {
+	acc := "t_ack"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a", "b", "c")})
+	ms := mustDequeue(t, acc, "q", 2, 30)
+	expectIDs(t, ms, 1, 2)
+	expectMeta(t, acc, "q", 1, 2, 0)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt, ms[1].Receipt}})
+	expectMeta(t, acc, "q", 1, 0, 0)
+	_, err := settleMessages(acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt}}, nil)
+	if !errors.Is(err, cd.ErrNotFound) {
+		t.Fatalf("expected not_found for acked message, got %v", err)
+	}
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 3)
+}
+
+func TestQueueNack(t *testing.T) {
+	acc := "t_nack"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a", "b")})
+	ms := mustDequeue(t, acc, "q", 1, 30)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Nack: []string{ms[0].Receipt}})
+	// returned to its place at the head of the queue
+	ms = mustDequeue(t, acc, "q", 1, 30)
+	expectIDs(t, ms, 1)
+	if ms[0].Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %v", ms[0].Attempts)
+	}
+}
+
+func TestQueueNackDelay(t *testing.T) {
+	acc := "t_nack_delay"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a")})
+	ms := mustDequeue(t, acc, "q", 1, 30)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Nack: []string{ms[0].Receipt}, Delay: 60})
+	expectMeta(t, acc, "q", 0, 0, 1)
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30))
+	_, err := deliverDelayed(time.Now().Unix() + 61)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMeta(t, acc, "q", 1, 0, 0)
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 1)
+}
+
+func TestQueueLeaseExpiry(t *testing.T) {
+	acc := "t_expiry"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("a")})
+	// client lock with the key of the lease must not block it
+	_, err := memLock(acc, leaseID("q", 1), 30, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, mustDequeue(t, acc, "q", 1, 1), 1)
+	time.Sleep(2500 * time.Millisecond)
+	expectMeta(t, acc, "q", 1, 0, 0)
+	ms := mustDequeue(t, acc, "q", 1, 30)
+	expectIDs(t, ms, 1)
+	if ms[0].Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %v", ms[0].Attempts)
+	}
+}
+
+func TestQueueGroups(t *testing.T) {
+	acc := "t_groups"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "g", Messages: msgs("g1", "g2")})
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "h", Messages: msgs("h1")})
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "g", Messages: msgs("g3")})
+	// one message per group at a time
+	ms := mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1, 3)
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30))
+
+	// nacked message keeps the group busy and is delivered again first
+	mustSettle(t, acc, QueueRequest{Queue: "q", Nack: []string{ms[0].Receipt}, Ack: []string{ms[1].Receipt}})
+	ms = mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1)
+
+	mustSettle(t, acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt}})
+	ms = mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 2)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt}})
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 4)
+}
+
+func TestQueueGroupNackDelay(t *testing.T) {
+	acc := "t_group_delay"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "g", Messages: msgs("g1", "g2")})
+	ms := mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Nack: []string{ms[0].Receipt}, Delay: 60})
+	// group is blocked while its head waits for redelivery
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30))
+	_, err := deliverDelayed(time.Now().Unix() + 61)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms = mustDequeue(t, acc, "q", 10, 30)
+	expectIDs(t, ms, 1)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Ack: []string{ms[0].Receipt}})
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 2)
+}
+
+func TestQueueGroupCancelDelayed(t *testing.T) {
+	acc := "t_group_cancel"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "g", Messages: msgs("g1", "g2")})
+	ms := mustDequeue(t, acc, "q", 10, 30)
+	mustSettle(t, acc, QueueRequest{Queue: "q", Nack: []string{ms[0].Receipt}, Delay: 60})
+	mustSettle(t, acc, QueueRequest{Queue: "q", Cancel: []int64{1}})
+	expectMeta(t, acc, "q", 1, 0, 0)
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 2)
+}
+
+func TestQueueGroupLeaseExpiry(t *testing.T) {
+	acc := "t_group_expiry"
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Group: "g", Messages: msgs("g1", "g2")})
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 1), 1)
+	time.Sleep(2500 * time.Millisecond)
+	// expired message is still the head of its group
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 1)
+}
+
+func TestQueueGroupDelayRejected(t *testing.T) {
+	acc := "t_group_delay_rejected"
+	_, err := testEnqueue(acc, EnqueueOp{Queue: "q", Group: "g", Delay: 60, Messages: msgs("g1")})
+	if err == nil {
+		t.Fatal("expected delayed grouped message to be rejected")
+	}
+	_, err = testEnqueue(acc, EnqueueOp{Queue: "q", Group: "g", DeliverAt: time.Now().Unix() + 60, Messages: msgs("g1")})
+	if err == nil {
+		t.Fatal("expected delayed grouped message to be rejected")
+	}
+}
+
+func TestQueuePriorities(t *testing.T) {
+	acc := "t_prio"
+	err := setQueuePolicy(acc, "q", QueuePolicy{Priorities: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Messages: msgs("low")})
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Priority: 2, Messages: msgs("high")})
+	mustEnqueue(t, acc, EnqueueOp{Queue: "q", Priority: 1, Messages: msgs("mid")})
+	expectIDs(t, mustDequeue(t, acc, "q", 10, 30), 2, 3, 1)
+}
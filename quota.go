@@ -0,0 +1,179 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Quota limits resources of a single account. 0 - no limit.
+type Quota struct {
+	MaxKeys      int64 `yaml:"MaxKeys"`
+	MaxBytes     int64 `yaml:"MaxBytes"` // total size of values
+	MaxValueSize int   `yaml:"MaxValueSize"`
+	MaxRPS       int   `yaml:"MaxRPS"`
+	MaxWatchers  int   `yaml:"MaxWatchers"` // concurrent /watch requests
+	MaxWaiters   int   `yaml:"MaxWaiters"`  // concurrent requests waiting for a lock
+}
+
+type QuotaConfig struct {
+	Default  Quota            `yaml:"Default"`
+	Accounts map[string]Quota `yaml:"Accounts"` // overrides Default
+}
+
+func accQuota(acc string) Quota {
+	if q, ok := cfg.Quotas.Accounts[acc]; ok {
+		return q
+	}
+	return cfg.Quotas.Default
+}
+
+func quotaErr(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %v", cd.ErrQuotaExceeded, fmt.Sprintf(format, args...))
+}
+
+const (
+	usageKeys  = "keys"
+	usageBytes = "bytes"
+)
+
+// updateUsage tracks number of keys & bytes used by account in the same
+// batch as the write itself and checks them against the quota.
+func updateUsage(acc string, b *pebble.Batch, old *cd.KV, v *KV) error {
+	q := accQuota(acc)
+	if !v.Delete && q.MaxValueSize != 0 && len(v.Value) > q.MaxValueSize {
+		return quotaErr("value size %v > %v", len(v.Value), q.MaxValueSize)
+	}
+	var dKeys, dBytes int64
+	if old != nil {
+		dKeys--
+		dBytes -= int64(len(old.Data))
+	}
+	if !v.Delete {
+		dKeys++
+		dBytes += int64(len(v.Value))
+	}
+	keys, err := addUsage(acc, b, usageKeys, dKeys)
+	if err != nil {
+		return err
+	}
+	if dKeys > 0 && q.MaxKeys != 0 && keys > q.MaxKeys {
+		return quotaErr("max keys %v", q.MaxKeys)
+	}
+	size, err := addUsage(acc, b, usageBytes, dBytes)
+	if err != nil {
+		return err
+	}
+	if dBytes > 0 && q.MaxBytes != 0 && size > q.MaxBytes {
+		return quotaErr("max bytes %v", q.MaxBytes)
+	}
+	return nil
+}
+
+// addMsgUsage tracks size of queue & topic messages. Messages count
+// towards MaxBytes, but not towards MaxKeys.
+func addMsgUsage(acc string, b *pebble.Batch, m *cd.QueueMsg, sign int64) error {
+	delta := sign * int64(len(m.Data))
+	size, err := addUsage(acc, b, usageBytes, delta)
+	if err != nil {
+		return err
+	}
+	q := accQuota(acc)
+	if delta > 0 && q.MaxBytes != 0 && size > q.MaxBytes {
+		return quotaErr("max bytes %v", q.MaxBytes)
+	}
+	return nil
+}
+
+func addUsage(acc string, b *pebble.Batch, name string, delta int64) (int64, error) {
+	id := compID(cd.UsagePrefix, acc, name)
+	val, err := GetInt64(id, b)
+	if err != nil {
+		return 0, err
+	}
+	var v int64
+	if val != nil {
+		v = *val
+	}
+	if delta == 0 {
+		return v, nil
+	}
+	v += delta
+	if v < 0 { // data written before usage was tracked
+		v = 0
+	}
+	return v, SetInt64(id, v, b)
+}
+
+func getUsage(acc string, b pebble.Reader, name string) (int64, error) {
+	val, err := GetInt64(compID(cd.UsagePrefix, acc, name), b)
+	if err != nil || val == nil {
+		return 0, err
+	}
+	return *val, nil
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rlMu sync.Mutex
+var rateBuckets = map[string]*rateBucket{}
+
+// allowRequest is a token bucket with capacity of 1 second of requests
+func allowRequest(acc string) error {
+	q := accQuota(acc)
+	if q.MaxRPS == 0 {
+		return nil
+	}
+	now := time.Now()
+	rlMu.Lock()
+	defer rlMu.Unlock()
+	rb, ok := rateBuckets[acc]
+	if !ok {
+		rb = &rateBucket{tokens: float64(q.MaxRPS), last: now}
+		rateBuckets[acc] = rb
+	}
+	rb.tokens += now.Sub(rb.last).Seconds() * float64(q.MaxRPS)
+	if rb.tokens > float64(q.MaxRPS) {
+		rb.tokens = float64(q.MaxRPS)
+	}
+	rb.last = now
+	if rb.tokens < 1 {
+		return quotaErr("max %v requests per second", q.MaxRPS)
+	}
+	rb.tokens--
+	return nil
+}
+
+// concurrency limiter for long-polling requests
+type slots struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+var watchSlots = &slots{m: map[string]int{}}
+var waitSlots = &slots{m: map[string]int{}}
+
+func (s *slots) acquire(acc string, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max != 0 && s.m[acc] >= max {
+		return false
+	}
+	s.m[acc]++
+	return true
+}
+
+func (s *slots) release(acc string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[acc]--
+	if s.m[acc] <= 0 {
+		delete(s.m, acc)
+	}
+}
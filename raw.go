@@ -0,0 +1,121 @@
+package main
+
+import (
+	"clouddragon/cd"
+	"fmt"
+	"strconv"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Raw endpoints store request body as is, without JSON wrapping.
+// Values share storage, versions and notifications with JSON API:
+//
+//	GET    /kv/:acc/*key  - returns value with its Content-Type
+//	PUT    /kv/:acc/*key  - sets value
+//	DELETE /kv/:acc/*key  - deletes value
+//
+// Version of the value is returned in X-Version header.
+func rawKey(ctx *fasthttp.RequestCtx) (string, string, error) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	key := strings.TrimPrefix(ctx.UserValue("key").(string), "/")
+	if key == "" {
+		return "", "", fmt.Errorf("key is empty")
+	}
+	return acc, key, nil
+}
+
+func RawGetHandler(ctx *fasthttp.RequestCtx) {
+	acc, key, err := rawKey(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if !checkAuth(ctx, access{acc, key, PermRead}) {
+		return
+	}
+	err = allowRequest(acc)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	v, err := getKV(acc, store.db, key)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if v == nil {
+		writeError(ctx, fmt.Errorf("%w: %v", cd.ErrNotFound, key))
+		return
+	}
+	ct := v.ContentType
+	if ct == "" {
+		ct = "application/json"
+	}
+	ctx.Response.Header.Set("X-Version", strconv.FormatInt(v.Version, 10))
+	ctx.SetContentType(ct)
+	ctx.Response.SetBody(v.Data)
+}
+
+func RawPutHandler(ctx *fasthttp.RequestCtx) {
+	acc, key, err := rawKey(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	ct := string(ctx.Request.Header.ContentType())
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	body := append([]byte{}, ctx.Request.Body()...)
+	if strings.HasPrefix(ct, "application/json") {
+		if !json.Valid(body) {
+			writeError(ctx, fmt.Errorf("invalid JSON"))
+			return
+		}
+		ct = "" // store as regular JSON value
+	}
+	kv := &KV{
+		Key:         key,
+		Value:       body,
+		ContentType: ct,
+	}
+	rawWrite(ctx, acc, kv)
+}
+
+func RawDeleteHandler(ctx *fasthttp.RequestCtx) {
+	acc, key, err := rawKey(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	rawWrite(ctx, acc, &KV{Key: key, Delete: true})
+}
+
+func rawWrite(ctx *fasthttp.RequestCtx, acc string, kv *KV) {
+	if !checkAuth(ctx, access{acc, kv.Key, PermWrite}) {
+		return
+	}
+	req := Request{
+		KVSet:  []*KV{kv},
+		Writer: string(ctx.Request.Header.Peek("X-Writer")),
+	}
+	idempotencyKeys(ctx, &req)
+	res, err := handle(acc, req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if res.Replay { // version of the original write is unknown
+		ctx.Response.Header.Set("Idempotent-Replayed", "true")
+		ctx.SetStatusCode(204)
+		return
+	}
+	ctx.Response.Header.Set("X-Version", strconv.FormatInt(kv.Version, 10))
+	ctx.SetStatusCode(204)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"clouddragon/cd"
+
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// ReadRequest reads keys and counters of multiple accounts from a single
+// pebble snapshot. It doesn't take account mutex and doesn't wait for
+// the writes of other requests, so it won't slow down the write path.
+type ReadRequest struct {
+	// By default reads could return data that was written, but not yet
+	// flushed to disk (and could be lost on crash).
+	// Linearizable waits till everything read was flushed to disk.
+	Linearizable bool
+	KVGet        []ReadKV
+	Atomic       []ReadKV
+}
+
+type ReadKV struct {
+	Acc     string
+	Key     string
+	Path    string // JSONPath, only for KVGet
+	Version int64  // past version, only for KVGet
+}
+
+type ReadKVRes struct {
+	Acc string
+	KV
+}
+
+type ReadAtomicRes struct {
+	Acc   string `json:"a"`
+	Key   string `json:"k"`
+	Value int64  `json:"v"`
+}
+
+type ReadResponse struct {
+	KVGet  []ReadKVRes     `json:"kv,omitempty"`
+	Atomic []ReadAtomicRes `json:"atm,omitempty"`
+}
+
+func handleRead(req ReadRequest) (ReadResponse, error) {
+	var res ReadResponse
+	snap := store.db.NewSnapshot()
+	defer snap.Close()
+	if req.Linearizable {
+		// every write visible in snapshot was committed before we took it,
+		// so it will be flushed not later than the next flush.
+		err := store.WaitFlush()
+		if err != nil {
+			return res, err
+		}
+	}
+	for _, v := range req.KVGet {
+		err := validAcc(v.Acc)
+		if err != nil {
+			return res, err
+		}
+		var r Response
+		op := KVGetOp{Key: v.Key, Path: v.Path, Version: v.Version}
+		err = handleKVGet(v.Acc, snap, op, &r)
+		if err != nil {
+			return res, err
+		}
+		res.KVGet = append(res.KVGet, ReadKVRes{Acc: v.Acc, KV: r.KVGet[0]})
+	}
+	for _, v := range req.Atomic {
+		err := validAcc(v.Acc)
+		if err != nil {
+			return res, err
+		}
+		val, err := GetInt64(compID(cd.AtomicPrefix, v.Acc, v.Key), snap)
+		if err != nil {
+			return res, err
+		}
+		r := ReadAtomicRes{Acc: v.Acc, Key: v.Key}
+		if val != nil {
+			r.Value = *val
+		}
+		res.Atomic = append(res.Atomic, r)
+	}
+	return res, nil
+}
+
+func ReadHandler(ctx *fasthttp.RequestCtx) {
+	var req ReadRequest
+	err := json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var acl []access
+	for _, v := range req.KVGet {
+		acl = append(acl, access{v.Acc, v.Key, PermRead})
+	}
+	for _, v := range req.Atomic {
+		acl = append(acl, access{v.Acc, v.Key, PermRead})
+	}
+	if !checkAuth(ctx, acl...) {
+		return
+	}
+	seen := map[string]bool{}
+	for _, a := range acl {
+		if seen[a.Acc] {
+			continue
+		}
+		seen[a.Acc] = true
+		err = allowRequest(a.Acc)
+		if err != nil {
+			writeError(ctx, err)
+			return
+		}
+	}
+	res, err := handleRead(req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	d, err := json.Marshal(res)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	ctx.Response.SetBody(d)
+}
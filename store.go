@@ -21,6 +21,7 @@
 package main
 
 import (
+	"clouddragon/cd"
 	"context"
 	"fmt"
 	"hash/fnv"
@@ -41,10 +42,6 @@ type Store struct {
 	stopped bool // graceful shudown
 	pending int  // number of requests inflight (track for graceful shutdown)
 }
-type SchedQueueMsg struct {
-	QID  string `json:"qid,omitempty"` // id of the queue
-	Data string `json:"raw,omitempty"` // message data
-}
 
 // Having multiple mutexes reduces on sync.Cond and sync.Mutex
 // proportional to amount of mutexes.
@@ -98,6 +95,21 @@ func (p *Store) Flush() int {
 	return pending
 }
 
+// WaitFlush waits till all writes committed before the call
+// are flushed to disk.
+func (p *Store) WaitFlush() error {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: DB stopped", cd.ErrStopped)
+	}
+	p.count++ // make sure flush will sync WAL
+	done := p.done
+	p.mu.Unlock()
+	<-done
+	return nil
+}
+
 // FlushLoop calls Flush constantly in a loop
 // TODO: check how sharding storages improves performance
 // Maybe it'll be easier to run & backup 100 of dbs (or db ranges) clumped up
@@ -161,7 +173,7 @@ func (p *Store) Singleton(key []byte, f SingletonFunc) error {
 	p.mu.Lock()
 	if p.stopped {
 		p.mu.Unlock()
-		return fmt.Errorf("DB stopped")
+		return fmt.Errorf("%w: DB stopped", cd.ErrStopped)
 	}
 	p.pending++
 	p.count++
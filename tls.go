@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type TLSConfig struct {
+	CertFile string `yaml:"CertFile"` // enables TLS
+	KeyFile  string `yaml:"KeyFile"`
+	// CA to verify client certificates. Subject CommonName of the verified
+	// certificate is matched against Subject of Auth.Keys
+	ClientCAFile      string `yaml:"ClientCAFile"`
+	RequireClientCert bool   `yaml:"RequireClientCert"`
+	// how often to check cert files for changes. Default 10s
+	ReloadInterval time.Duration `yaml:"ReloadInterval"`
+}
+
+// certificates are reloaded without restart when files change on disk
+type tlsReloader struct {
+	cfg     TLSConfig
+	current atomic.Pointer[tls.Config]
+	mtime   time.Time
+}
+
+func (r *tlsReloader) filesModTime() time.Time {
+	var res time.Time
+	for _, f := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		st, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if st.ModTime().After(res) {
+			res = st.ModTime()
+		}
+	}
+	return res
+}
+
+func (r *tlsReloader) load() error {
+	mtime := r.filesModTime()
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.cfg.ClientCAFile != "" {
+		d, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(d) {
+			return fmt.Errorf("no certificates in %v", r.cfg.ClientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.cfg.RequireClientCert {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	r.current.Store(c)
+	r.mtime = mtime
+	return nil
+}
+
+func (r *tlsReloader) reloadLoop() {
+	d := r.cfg.ReloadInterval
+	if d == 0 {
+		d = time.Second * 10
+	}
+	for range time.Tick(d) {
+		if !r.filesModTime().After(r.mtime) {
+			continue
+		}
+		err := r.load()
+		if err != nil {
+			log.Print("failed to reload TLS certificates: ", err)
+			continue
+		}
+		log.Print("TLS certificates reloaded")
+	}
+}
+
+// tlsState is the same as ctx.TLSConnectionState, but also works for
+// connections wrapped by fasthttp to limit MaxConnsPerIP
+func tlsState(ctx *fasthttp.RequestCtx) *tls.ConnectionState {
+	if st := ctx.TLSConnectionState(); st != nil {
+		return st
+	}
+	v := reflect.ValueOf(ctx.Conn())
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	f := v.FieldByName("Conn")
+	if !f.IsValid() || !f.CanInterface() {
+		return nil
+	}
+	c, ok := f.Interface().(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	st := c.ConnectionState()
+	return &st
+}
+
+// tlsListener wraps listener with TLS if configured
+func tlsListener(ln net.Listener, cfg TLSConfig) (net.Listener, error) {
+	if cfg.CertFile == "" {
+		return ln, nil
+	}
+	r := &tlsReloader{cfg: cfg}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	go r.reloadLoop()
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}), nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"clouddragon/cd"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	json "github.com/goccy/go-json"
+	"github.com/valyala/fasthttp"
+)
+
+// Topics are append-only logs of messages. Unlike queue messages, topic
+// messages are not removed when they are read - every consumer group
+// tracks offset of the last message it has processed.
+//
+// TableID|Account|0|Topic|0|Offset(big endian)  ->  cd.QueueMsg
+// TableID|Account|0|Topic                       ->  last offset
+// TableID|Account|0|Topic|0|Group               ->  committed offset
+func topicGroupID(acc, topic, group string) []byte {
+	b := compID(cd.TopicGroupPrefix, acc, topic)
+	b = append(b, 0)
+	return append(b, group...)
+}
+
+// TopicRule limits retention of messages of topics of the account that
+// start with Prefix. First matching rule is used. Without a rule messages
+// are kept forever.
+type TopicRule struct {
+	Account  string        `yaml:"Account"`  // empty - any account
+	Prefix   string        `yaml:"Prefix"`   // empty - any topic
+	Messages int64         `yaml:"Messages"` // keep last N messages. 0 - no limit
+	Duration time.Duration `yaml:"Duration"` // keep messages for T. 0 - no limit
+}
+
+func topicRule(acc, topic string) *TopicRule {
+	for i, r := range cfg.Topics {
+		if r.Account != "" && r.Account != acc {
+			continue
+		}
+		if strings.HasPrefix(topic, r.Prefix) {
+			return &cfg.Topics[i]
+		}
+	}
+	return nil
+}
+
+func topicWatchKey(topic string) string {
+	return "\x00topic\x00" + topic
+}
+
+func topicOffset(acc string, r pebble.Reader, topic string) (int64, error) {
+	v, err := GetInt64(compID(cd.TopicMetaPrefix, acc, topic), r)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return *v, nil
+}
+
+func groupOffset(acc string, r pebble.Reader, topic, group string) (int64, error) {
+	v, err := GetInt64(topicGroupID(acc, topic, group), r)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return *v, nil
+}
+
+type PublishRes struct {
+	Topic   string  `json:"t"`
+	Offsets []int64 `json:"offsets"`
+}
+
+func handlePublish(acc string, b *pebble.Batch, topic string, msgs []json.RawMessage) (PublishRes, error) {
+	res := PublishRes{Topic: topic}
+	err := validQueue(topic)
+	if err != nil {
+		return res, err
+	}
+	offset, err := topicOffset(acc, b, topic)
+	if err != nil {
+		return res, err
+	}
+	q := accQuota(acc)
+	now := time.Now().Unix()
+	for _, m := range msgs {
+		if q.MaxValueSize != 0 && len(m) > q.MaxValueSize {
+			return res, quotaErr("message size %v > %v", len(m), q.MaxValueSize)
+		}
+		offset++
+		rec := cd.QueueMsg{Enqueued: now}
+		d, err := encodeQueueMsg(&rec, m)
+		if err != nil {
+			return res, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = b.Set(queueMsgID(cd.TopicPrefix, acc, topic, offset), d, pebble.NoSync)
+		if err != nil {
+			return res, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = addMsgUsage(acc, b, &rec, 1)
+		if err != nil {
+			return res, err
+		}
+		res.Offsets = append(res.Offsets, offset)
+	}
+	if r := topicRule(acc, topic); r != nil && r.Messages > 0 {
+		_, err = trimTopic(acc, b, topic, offset-r.Messages, 0)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, SetInt64(compID(cd.TopicMetaPrefix, acc, topic), offset, b)
+}
+
+// trimTopic removes messages with offset <= last or published before
+// the given unix time. Messages are ordered by offset and time, so
+// iteration stops at the first message that is kept.
+func trimTopic(acc string, b *pebble.Batch, topic string, last, before int64) (int, error) {
+	iter, err := b.NewIter(queueBounds(cd.TopicPrefix, acc, topic))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		var m cd.QueueMsg
+		_, err := m.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return count, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		if queueMsgSeq(iter.Key()) > last && m.Enqueued >= before {
+			break
+		}
+		err = b.Delete(iter.Key(), pebble.NoSync)
+		if err != nil {
+			return count, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		err = addMsgUsage(acc, b, &m, -1)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// TopicSweepLoop removes topic messages older than Duration of their rule
+func TopicSweepLoop(ctx context.Context) {
+	for {
+		n, err := sweepTopics()
+		if err != nil {
+			log.Print("topic sweep failed: ", err)
+		}
+		if n > 0 {
+			log.Printf("removed %v expired topic messages", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func sweepTopics() (int, error) {
+	if len(cfg.Topics) == 0 {
+		return 0, nil
+	}
+	// last offset of every topic is stored in TopicMeta
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte{cd.TopicMetaPrefix},
+		UpperBound: []byte{cd.TopicMetaPrefix + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	now := time.Now()
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		a, t, _ := bytes.Cut(iter.Key()[1:], []byte{0})
+		acc, topic := string(a), string(t)
+		r := topicRule(acc, topic)
+		if r == nil || r.Duration == 0 {
+			continue
+		}
+		err := store.Singleton([]byte(acc), func() error {
+			b := store.db.NewIndexedBatch()
+			n, err := trimTopic(acc, b, topic, 0, now.Add(-r.Duration).Unix())
+			if err != nil || n == 0 {
+				return err
+			}
+			count += n
+			err = b.Commit(pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// notifyTopics wakes up consumers waiting for new messages
+func notifyTopics(acc string, res []PublishRes) {
+	for _, v := range res {
+		if len(v.Offsets) > 0 {
+			store.notifier(acc).NotifyVersion(topicWatchKey(v.Topic), v.Offsets[len(v.Offsets)-1])
+		}
+	}
+}
+
+type TopicMsg struct {
+	Offset    int64
+	Data      json.RawMessage
+	Published int64 // unix time
+}
+
+type GroupInfo struct {
+	Name      string
+	Committed int64 // offset of the last processed message
+	Lag       int64 // number of messages not processed yet
+}
+
+type TopicRes struct {
+	Messages []TopicMsg  `json:"msgs"`
+	Offset   int64       `json:"offset"` // offset of the last published message
+	Groups   []GroupInfo `json:"groups,omitempty"`
+	Publish  *PublishRes `json:"pub,omitempty"`
+	Replay   bool        `json:"replay,omitempty"` // publish was handled already
+}
+
+// readTopic returns up to max messages after offset. Waits for new
+// messages up to wait seconds if there are none.
+func readTopic(acc, topic string, after int64, max, wait int) (TopicRes, error) {
+	res := TopicRes{Messages: []TopicMsg{}}
+	if max <= 0 {
+		max = 100
+	}
+	max = min(max, 1000)
+	if wait > 0 {
+		if !watchSlots.acquire(acc, accQuota(acc).MaxWatchers) {
+			return res, quotaErr("max %v watchers", accQuota(acc).MaxWatchers)
+		}
+		defer watchSlots.release(acc)
+	}
+	n := store.notifier(acc)
+	key := topicWatchKey(topic)
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for {
+		left := int(math.Ceil(time.Until(deadline).Seconds()))
+		// attach under account lock, so that message published right
+		// after the check won't be missed
+		err := store.Singleton([]byte(acc), func() error {
+			var err error
+			res.Offset, err = topicOffset(acc, store.db, topic)
+			if err == nil && res.Offset <= after && left > 0 {
+				n.Attach(key, res.Offset)
+			}
+			return err
+		})
+		if err != nil {
+			return res, err
+		}
+		if res.Offset > after || left <= 0 {
+			break
+		}
+		n.Listen(key, res.Offset, left)
+	}
+	opts := queueBounds(cd.TopicPrefix, acc, topic)
+	opts.LowerBound = queueMsgID(cd.TopicPrefix, acc, topic, after+1)
+	iter, err := store.db.NewIter(opts)
+	if err != nil {
+		return res, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid() && len(res.Messages) < max; iter.Next() {
+		var m cd.QueueMsg
+		_, err := m.UnmarshalMsg(iter.Value())
+		if err != nil {
+			return res, fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		d, err := queueMsgData(&m)
+		if err != nil {
+			return res, err
+		}
+		res.Messages = append(res.Messages, TopicMsg{
+			Offset:    queueMsgSeq(iter.Key()),
+			Data:      d,
+			Published: m.Enqueued,
+		})
+	}
+	return res, nil
+}
+
+func commitOffset(acc, topic, group string, offset int64) error {
+	return store.Singleton([]byte(acc), func() error {
+		last, err := topicOffset(acc, store.db, topic)
+		if err != nil {
+			return err
+		}
+		if offset < 0 || offset > last {
+			return fmt.Errorf("offset %v is out of range 0~%v", offset, last)
+		}
+		b := store.db.NewBatch()
+		err = SetInt64(topicGroupID(acc, topic, group), offset, b)
+		if err != nil {
+			return err
+		}
+		err = b.Commit(pebble.NoSync)
+		if err != nil {
+			return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+		}
+		return nil
+	})
+}
+
+func topicGroups(acc, topic string, last int64) ([]GroupInfo, error) {
+	p := topicGroupID(acc, topic, "")
+	iter, err := store.db.NewIter(&pebble.IterOptions{
+		LowerBound: p,
+		UpperBound: append(p[:len(p)-1:len(p)-1], 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	res := []GroupInfo{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		c := ByteToInt64(iter.Value())
+		res = append(res, GroupInfo{
+			Name:      string(iter.Key()[len(p):]),
+			Committed: c,
+			Lag:       last - c,
+		})
+	}
+	return res, nil
+}
+
+type TopicRequest struct {
+	Topic   string
+	Publish []json.RawMessage
+	Group   string // consumer group
+	Commit  *int64 // offset of the last message processed by the Group
+	Read    int    // number of messages to read
+	After   *int64 // read messages after offset. Default - committed offset of the Group
+	Wait    int    // seconds to wait for messages if there are no new ones
+}
+
+func TopicHandler(ctx *fasthttp.RequestCtx) {
+	acc, err := getAcc(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var req TopicRequest
+	err = json.Unmarshal(ctx.Request.Body(), &req)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	err = validQueue(req.Topic)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if req.Group != "" {
+		err = validQueue(req.Group)
+		if err != nil {
+			writeError(ctx, fmt.Errorf("bad group: %w", err))
+			return
+		}
+	}
+	perm := PermRead
+	if len(req.Publish) > 0 {
+		perm = PermWrite
+	}
+	if !checkAuth(ctx, access{acc, req.Topic, perm}) {
+		return
+	}
+	err = allowRequest(acc)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	var res TopicRes
+	if len(req.Publish) > 0 {
+		// only publish is recorded, Commit & Read are repeated on replay
+		k := headerIdempotency(ctx, access{acc, req.Topic, perm})
+		var pub PublishRes
+		err = store.Singleton([]byte(acc), func() error {
+			b := store.db.NewIndexedBatch()
+			var err error
+			res.Replay, err = k.get(acc, b, &pub)
+			if res.Replay || err != nil {
+				return err
+			}
+			pub, err = handlePublish(acc, b, req.Topic, req.Publish)
+			if err != nil {
+				return err
+			}
+			err = k.save(acc, b, pub)
+			if err != nil {
+				return err
+			}
+			err = b.Commit(pebble.NoSync)
+			if err != nil {
+				return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(ctx, err)
+			return
+		}
+		if res.Replay {
+			ctx.Response.Header.Set("Idempotent-Replayed", "true")
+		} else {
+			notifyTopics(acc, []PublishRes{pub})
+		}
+		res.Publish = &pub
+	}
+	if req.Commit != nil {
+		if req.Group == "" {
+			writeError(ctx, fmt.Errorf("group is required to commit offset"))
+			return
+		}
+		err = commitOffset(acc, req.Topic, req.Group, *req.Commit)
+		if err != nil {
+			writeError(ctx, err)
+			return
+		}
+	}
+	if req.Read > 0 {
+		var after int64
+		if req.After != nil {
+			after = *req.After
+		} else if req.Group != "" {
+			after, err = groupOffset(acc, store.db, req.Topic, req.Group)
+			if err != nil {
+				writeError(ctx, err)
+				return
+			}
+		}
+		pub, replay := res.Publish, res.Replay
+		res, err = readTopic(acc, req.Topic, after, req.Read, req.Wait)
+		res.Publish, res.Replay = pub, replay
+	} else {
+		res.Messages = []TopicMsg{}
+		res.Offset, err = topicOffset(acc, store.db, req.Topic)
+		if err == nil {
+			res.Groups, err = topicGroups(acc, req.Topic, res.Offset)
+		}
+	}
+	writeJSON(ctx, res, err)
+}
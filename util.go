@@ -1,6 +1,7 @@
 package main
 
 import (
+	"clouddragon/cd"
 	"encoding/binary"
 	"fmt"
 
@@ -17,10 +18,10 @@ func ByteToInt64(d []byte) int64 {
 	return int64(binary.LittleEndian.Uint64(d))
 }
 
-func GetInt64(key []byte, b *pebble.Batch) (*int64, error) {
+func GetInt64(key []byte, b pebble.Reader) (*int64, error) {
 	d, closer, err := b.Get([]byte(key))
 	if err != nil && err != pebble.ErrNotFound {
-		return nil, fmt.Errorf("DB ERR %v", err.Error())
+		return nil, fmt.Errorf("%w: %v", cd.ErrInternal, err)
 	}
 	if err == pebble.ErrNotFound {
 		return nil, nil
@@ -33,7 +34,11 @@ func GetInt64(key []byte, b *pebble.Batch) (*int64, error) {
 func SetInt64(key []byte, val int64, b *pebble.Batch) error {
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint64(buf, uint64(val))
-	return b.Set(key, buf, pebble.NoSync)
+	err := b.Set(key, buf, pebble.NoSync)
+	if err != nil {
+		return fmt.Errorf("%w: %v", cd.ErrInternal, err)
+	}
+	return nil
 }
 
 // TableID|Account|0|ID
@@ -47,6 +52,13 @@ func compID(prefix int, acc, id string) []byte {
 	return b
 }
 
+// accUpperBound returns key that is greater than any compID(prefix, acc, ...)
+func accUpperBound(prefix int, acc string) []byte {
+	b := compID(prefix, acc, "")
+	b[len(b)-1] = 1
+	return b
+}
+
 // TableID|ID
 // 0 byte delimited is used to construct composite key from Acc and ID
 func compID1(prefix int, id string) []byte {
@@ -64,13 +76,21 @@ func fromCompID1(key []byte) string {
 
 func getAcc(ctx *fasthttp.RequestCtx) (string, error) {
 	acc := ctx.UserValue("acc").(string)
+	err := validAcc(acc)
+	if err != nil {
+		return "", err
+	}
+	return acc, nil
+}
+
+func validAcc(acc string) error {
 	if len(acc) > 255 || len(acc) == 0 {
-		return "", fmt.Errorf("len is not in range 0~255")
+		return fmt.Errorf("len is not in range 0~255")
 	}
 	for _, v := range acc {
 		if v == 0 {
-			return "", fmt.Errorf("0 is not allowed as a character in acc name")
+			return fmt.Errorf("0 is not allowed as a character in acc name")
 		}
 	}
-	return acc, nil
+	return nil
 }